@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -17,9 +18,138 @@ var LoggingOutput string
 
 var JwtSecret []byte
 
-var OllamaHost string
+type OllamaBackend struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+var OllamaBackends []OllamaBackend
+var OllamaBalance string
 var OllamaTimeout int
 
+// RouteTimeout limits one upstream request in seconds, 0 disables a limit.
+type RouteTimeout struct {
+	Connect   int `mapstructure:"connect"`
+	FirstByte int `mapstructure:"first_byte"`
+	Idle      int `mapstructure:"idle"`
+	Total     int `mapstructure:"total"`
+}
+
+// OllamaTimeouts is keyed by route class: chat, embed, model and default.
+var OllamaTimeouts map[string]RouteTimeout
+
+var OllamaRetryAttempts int
+var OllamaRetryBackoff int
+var OllamaRetryMaxBackoff int
+
+var OllamaBreakerFailureThreshold int
+var OllamaBreakerOpenDuration int
+var OllamaBreakerHalfOpenRequests int
+
+var OllamaHealthInterval int
+var OllamaHealthTimeout int
+var OllamaUnhealthyThreshold int
+var OllamaHealthyThreshold int
+
+var OllamaInventoryInterval int
+
+type RoleLimit struct {
+	Concurrent        int `mapstructure:"concurrent"`
+	QueueWeight       int `mapstructure:"queue_weight"`
+	RequestsPerMinute int `mapstructure:"requests_per_minute"`
+	TokensPerMinute   int `mapstructure:"tokens_per_minute"`
+	TokensPerHour     int `mapstructure:"tokens_per_hour"`
+}
+
+// ProxyRoute exposes an Ollama endpoint. Path is a gin pattern such as /api/blobs/:digest.
+type ProxyRoute struct {
+	Path    string   `mapstructure:"path"`
+	Methods []string `mapstructure:"methods"`
+	Scope   string   `mapstructure:"scope"`
+	// usage recorded for the route: none, generate, chat, completion or embedding
+	Count string `mapstructure:"count"`
+	// request body limit in bytes, 0 uses proxy.max_body_size, negative streams the body through unread
+	BodyLimit int64 `mapstructure:"body_limit"`
+	// timeout class, see OllamaTimeouts
+	Timeout string `mapstructure:"timeout"`
+	// path on Ollama, empty forwards to the same path
+	Upstream string `mapstructure:"upstream"`
+}
+
+var ProxyMaxBodySize int64
+var ProxyRoutes []ProxyRoute
+
+// DefaultProxyRoutes covers the Ollama and OpenAI compatible API, proxy.routes entries replace those with
+// the same path or add new ones.
+var DefaultProxyRoutes = []ProxyRoute{
+	{Path: "/api/generate", Methods: []string{"POST"}, Scope: "inference", Count: "generate", Timeout: "chat"},
+	{Path: "/api/chat", Methods: []string{"POST"}, Scope: "inference", Count: "chat", Timeout: "chat"},
+	{Path: "/v1/chat/completions", Methods: []string{"POST"}, Scope: "inference", Count: "chat", Timeout: "chat"},
+	{Path: "/v1/completions", Methods: []string{"POST"}, Scope: "inference", Count: "completion", Timeout: "chat"},
+	// Anthropic Messages API and OpenAI Responses API, translated to /api/chat
+	{Path: "/v1/messages", Methods: []string{"POST"}, Scope: "inference", Count: "chat", Timeout: "chat", Upstream: "/api/chat"},
+	{Path: "/v1/responses", Methods: []string{"POST"}, Scope: "inference", Count: "chat", Timeout: "chat", Upstream: "/api/chat"},
+	{Path: "/api/embed", Methods: []string{"POST"}, Scope: "embeddings", Count: "embedding", Timeout: "embed"},
+	{Path: "/api/embeddings", Methods: []string{"POST"}, Scope: "embeddings", Count: "embedding", Timeout: "embed"},
+	{Path: "/v1/embeddings", Methods: []string{"POST"}, Scope: "embeddings", Count: "embedding", Timeout: "embed"},
+	{Path: "/api/tags", Methods: []string{"GET"}, Scope: "models:read"},
+	{Path: "/api/show", Methods: []string{"POST"}, Scope: "models:read"},
+	{Path: "/api/ps", Methods: []string{"GET"}, Scope: "models:read"},
+	{Path: "/api/version", Methods: []string{"GET"}, Scope: "models:read"},
+	{Path: "/v1/models", Methods: []string{"GET"}, Scope: "models:read"},
+	{Path: "/api/create", Methods: []string{"POST"}, Scope: "models:write", Timeout: "model"},
+	{Path: "/api/copy", Methods: []string{"POST"}, Scope: "models:write"},
+	{Path: "/api/pull", Methods: []string{"POST"}, Scope: "models:write", Timeout: "model"},
+	{Path: "/api/push", Methods: []string{"POST"}, Scope: "models:write", Timeout: "model"},
+	{Path: "/api/delete", Methods: []string{"DELETE"}, Scope: "models:write"},
+	// model files uploaded by "ollama create", far too large to buffer
+	{Path: "/api/blobs/:digest", Methods: []string{"HEAD", "POST"}, Scope: "models:write", BodyLimit: -1, Timeout: "model"},
+}
+
+var GlobalConcurrent int
+var RoleLimits map[string]RoleLimit
+
+var QueueSize int
+var QueueMaxWait int
+
+type Classifier struct {
+	URL           string `mapstructure:"url"`
+	Token         string `mapstructure:"token"`
+	Model         string `mapstructure:"model"`
+	Timeout       int    `mapstructure:"timeout"`
+	BlockedPrefix string `mapstructure:"blocked_prefix"`
+	FailOpen      bool   `mapstructure:"fail_open"`
+}
+
+var ModerationEnabled bool
+var ModerationKeywords []string
+var ModerationPatterns []string
+var ModerationClassifier Classifier
+
+type RedactionPattern struct {
+	Name    string `mapstructure:"name"`
+	Pattern string `mapstructure:"pattern"`
+}
+
+var RedactionEnabled bool
+var RedactionDetectors []string
+var RedactionCustom []RedactionPattern
+var RedactionResponse bool
+
+var CacheEnabled bool
+var CacheShared bool
+var CacheTTL int
+var CacheMaxSize int
+var CacheMaxEntrySize int
+
+var MetricsEnabled bool
+var MetricsToken string
+
+var AuditAll bool
+var AuditMaxPromptSize int
+var AuditMaxResponseSize int
+var AuditRetentionDays int
+
 func ReadConfig() {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -54,8 +184,107 @@ func initValue() {
 
 	JwtSecret = []byte(GetStringWithDefault("server.jwtkey", "jwt_secret_key"))
 
-	OllamaHost = GetStringWithDefault("ollama.url", "http://localhost:11434")
+	OllamaBackends = nil
+	if err := viper.UnmarshalKey("ollama.backends", &OllamaBackends); err != nil {
+		panic(err)
+	}
+	if len(OllamaBackends) == 0 {
+		// 兼容旧的单节点配置
+		OllamaBackends = []OllamaBackend{{URL: GetStringWithDefault("ollama.url", "http://localhost:11434"), Weight: 1}}
+	}
+	OllamaBalance = GetStringWithDefault("ollama.balance", "round_robin")
 	OllamaTimeout = GetIntWithDefault("ollama.timeout", 300)
+	OllamaTimeouts = map[string]RouteTimeout{
+		// loading a model before the first token can take minutes
+		"chat":  {Connect: 10, FirstByte: 300, Idle: 60, Total: 0},
+		"embed": {Connect: 10, FirstByte: 300, Idle: 60, Total: 600},
+		// non-streamed pulls only answer once the download is done
+		"model":   {Connect: 10, FirstByte: 0, Idle: 600, Total: 0},
+		"default": {Connect: 10, FirstByte: 30, Idle: 30, Total: 60},
+	}
+	for class, timeout := range OllamaTimeouts {
+		// fields missing from the config keep their defaults
+		if err := viper.UnmarshalKey("ollama.timeouts."+class, &timeout); err != nil {
+			panic(err)
+		}
+		OllamaTimeouts[class] = timeout
+	}
+
+	OllamaRetryAttempts = GetIntWithDefault("ollama.retry.attempts", 2)
+	OllamaRetryBackoff = GetIntWithDefault("ollama.retry.backoff", 200)
+	OllamaRetryMaxBackoff = GetIntWithDefault("ollama.retry.max_backoff", 2000)
+
+	OllamaBreakerFailureThreshold = GetIntWithDefault("ollama.circuit_breaker.failure_threshold", 5)
+	OllamaBreakerOpenDuration = GetIntWithDefault("ollama.circuit_breaker.open_duration", 30)
+	OllamaBreakerHalfOpenRequests = GetIntWithDefault("ollama.circuit_breaker.half_open_requests", 1)
+
+	OllamaHealthInterval = GetIntWithDefault("ollama.health_check.interval", 10)
+	OllamaHealthTimeout = GetIntWithDefault("ollama.health_check.timeout", 5)
+	OllamaUnhealthyThreshold = GetIntWithDefault("ollama.health_check.unhealthy_threshold", 3)
+	OllamaHealthyThreshold = GetIntWithDefault("ollama.health_check.healthy_threshold", 2)
+
+	OllamaInventoryInterval = GetIntWithDefault("ollama.inventory_interval", 30)
+
+	ProxyMaxBodySize = int64(GetIntWithDefault("proxy.max_body_size", 32<<20))
+	var routes []ProxyRoute
+	if err := viper.UnmarshalKey("proxy.routes", &routes); err != nil {
+		panic(err)
+	}
+	ProxyRoutes = append([]ProxyRoute(nil), DefaultProxyRoutes...)
+	for _, route := range routes {
+		if i := slices.IndexFunc(ProxyRoutes, func(r ProxyRoute) bool { return r.Path == route.Path }); i >= 0 {
+			ProxyRoutes[i] = route
+		} else {
+			ProxyRoutes = append(ProxyRoutes, route)
+		}
+	}
+
+	GlobalConcurrent = GetIntWithDefault("limits.global_concurrent", 200)
+	RoleLimits = map[string]RoleLimit{
+		"admin": {Concurrent: 0, QueueWeight: 2},
+		"user":  {Concurrent: 4, QueueWeight: 1},
+	}
+	if err := viper.UnmarshalKey("limits.roles", &RoleLimits); err != nil {
+		panic(err)
+	}
+	QueueSize = GetIntWithDefault("limits.queue.size", 100)
+	QueueMaxWait = GetIntWithDefault("limits.queue.max_wait", 30)
+
+	ModerationEnabled = viper.GetBool("moderation.enabled")
+	ModerationKeywords = viper.GetStringSlice("moderation.keywords")
+	ModerationPatterns = viper.GetStringSlice("moderation.patterns")
+	ModerationClassifier = Classifier{Timeout: 10, BlockedPrefix: "unsafe", FailOpen: true}
+	if err := viper.UnmarshalKey("moderation.classifier", &ModerationClassifier); err != nil {
+		panic(err)
+	}
+	if ModerationClassifier.BlockedPrefix == "" {
+		ModerationClassifier.BlockedPrefix = "unsafe"
+	}
+
+	RedactionEnabled = viper.GetBool("redaction.enabled")
+	RedactionDetectors = []string{"email", "phone", "credit_card", "national_id"}
+	if viper.IsSet("redaction.detectors") {
+		RedactionDetectors = viper.GetStringSlice("redaction.detectors")
+	}
+	RedactionCustom = nil
+	if err := viper.UnmarshalKey("redaction.custom", &RedactionCustom); err != nil {
+		panic(err)
+	}
+	RedactionResponse = viper.GetBool("redaction.response")
+
+	CacheEnabled = viper.GetBool("cache.enabled")
+	CacheShared = viper.GetBool("cache.shared")
+	CacheTTL = GetIntWithDefault("cache.ttl", 3600)
+	CacheMaxSize = GetIntWithDefault("cache.max_size", 256<<20)
+	CacheMaxEntrySize = GetIntWithDefault("cache.max_entry_size", 8<<20)
+
+	MetricsEnabled = viper.GetBool("metrics.enabled")
+	MetricsToken = viper.GetString("metrics.token")
+
+	AuditAll = viper.GetBool("audit.all")
+	AuditMaxPromptSize = GetIntWithDefault("audit.max_prompt_size", 64<<10)
+	AuditMaxResponseSize = GetIntWithDefault("audit.max_response_size", 64<<10)
+	AuditRetentionDays = GetIntWithDefault("audit.retention_days", 30)
 }
 
 func GetStringWithDefault(key string, defaultValue string) string {
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"net/http"
+	"safe-ollama/middleware"
+	"safe-ollama/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func AuditHandler(router *gin.Engine, db *gorm.DB) {
+	r := router.Group("/api/audit", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	r.GET("/", searchAuditRecords(db))
+	r.GET("/:id", getAuditRecord(db))
+}
+
+type AuditSummaryResult struct {
+	ID          uint      `json:"id"`
+	UserId      uint      `json:"userId"`
+	TokenId     uint      `json:"tokenId"`
+	Path        string    `json:"path"`
+	OllamaModel string    `json:"model"`
+	Status      int       `json:"status"`
+	Truncated   bool      `json:"truncated"`
+	DurationMs  int64     `json:"durationMs"`
+	Time        time.Time `json:"time"`
+}
+
+type AuditRecordResult struct {
+	AuditSummaryResult
+	Prompt   string `json:"prompt"`
+	Response string `json:"response"`
+}
+
+// GET /api/audit/?user_id=1&token_id=2&model=llama3.2&q=keyword&start=2024-01-01&end=2024-01-31&limit=50&offset=0
+func searchAuditRecords(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var filter struct {
+			UserID  uint   `form:"user_id"`
+			TokenID uint   `form:"token_id"`
+			Model   string `form:"model"`
+			Query   string `form:"q"`
+			Limit   int    `form:"limit"`
+			Offset  int    `form:"offset"`
+		}
+		if err := c.ShouldBindQuery(&filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request"})
+			return
+		}
+		start, end := parseTimeRange(c)
+		end = end.AddDate(0, 0, 1)
+		if filter.Limit <= 0 || filter.Limit > 500 {
+			filter.Limit = 50
+		}
+
+		query := db.Model(&model.AuditRecord{}).Where("time BETWEEN ? AND ?", start, end)
+		if filter.UserID > 0 {
+			query = query.Where("user_id = ?", filter.UserID)
+		}
+		if filter.TokenID > 0 {
+			query = query.Where("token_id = ?", filter.TokenID)
+		}
+		if filter.Model != "" {
+			query = query.Where("ollama_model = ?", filter.Model)
+		}
+		if filter.Query != "" {
+			like := "%" + filter.Query + "%"
+			query = query.Where("prompt LIKE ? OR response LIKE ?", like, like)
+		}
+
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search audit records"})
+			return
+		}
+		var records []AuditSummaryResult
+		if err := query.Order("id desc").Limit(filter.Limit).Offset(filter.Offset).Find(&records).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search audit records"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"total": total, "records": records})
+	}
+}
+
+func getAuditRecord(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var record model.AuditRecord
+		if err := db.First(&record, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Audit record not found"})
+			return
+		}
+		c.JSON(http.StatusOK, AuditRecordResult{
+			AuditSummaryResult: AuditSummaryResult{
+				ID:          record.ID,
+				UserId:      record.UserId,
+				TokenId:     record.TokenId,
+				Path:        record.Path,
+				OllamaModel: record.OllamaModel,
+				Status:      record.Status,
+				Truncated:   record.Truncated,
+				DurationMs:  record.DurationMs,
+				Time:        record.Time,
+			},
+			Prompt:   record.Prompt,
+			Response: record.Response,
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"net/http"
+	"safe-ollama/middleware"
+	"safe-ollama/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CacheHandler(router *gin.Engine) {
+	r := router.Group("/api/cache", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	r.GET("/", getCacheStats())
+	r.DELETE("/", purgeCache())
+}
+
+func getCacheStats() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, middleware.GetCacheStats())
+	}
+}
+
+// DELETE /api/cache/?model=llama3.2
+func purgeCache() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		removed := middleware.PurgeCache(c.Query("model"))
+		c.JSON(http.StatusOK, gin.H{"message": "Cache purged", "removed": removed})
+	}
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"net/http"
+	"safe-ollama/middleware"
+	"safe-ollama/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func InflightHandler(router *gin.Engine) {
+	r := router.Group("/api/inflight", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	r.GET("/", listInflight())
+	r.DELETE("/:id", cancelInflight())
+}
+
+func listInflight() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, middleware.ListInflight())
+	}
+}
+
+func cancelInflight() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !middleware.CancelInflight(c.Param("id")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Request cancelled"})
+	}
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"net/http"
+	"safe-ollama/config"
+	"safe-ollama/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsHandler serves Prometheus metrics on /metrics, scrapers authenticate with metrics.token if set.
+func MetricsHandler(router *gin.Engine) {
+	if !config.MetricsEnabled {
+		return
+	}
+	router.GET("/metrics", func(c *gin.Context) {
+		if config.MetricsToken != "" && c.GetHeader("Authorization") != "Bearer "+config.MetricsToken {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid metrics token"})
+			return
+		}
+		metrics.Handler().ServeHTTP(c.Writer, c.Request)
+	})
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"net/http"
+	"safe-ollama/middleware"
+	"safe-ollama/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func ModerationHandler(router *gin.Engine, db *gorm.DB) {
+	r := router.Group("/api/moderation", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	r.GET("/logs", getModerationLogs(db))
+	r.GET("/redactions", getRedactionSummary(db))
+}
+
+type ModerationLogResult struct {
+	ID          uint      `json:"id"`
+	UserId      uint      `json:"userId"`
+	TokenId     uint      `json:"tokenId"`
+	Path        string    `json:"path"`
+	OllamaModel string    `json:"model"`
+	Blocked     bool      `json:"blocked"`
+	Moderator   string    `json:"moderator"`
+	Reason      string    `json:"reason"`
+	Time        time.Time `json:"time"`
+}
+
+// GET /api/moderation/logs?user_id=1&blocked=true&start=2024-01-01&end=2024-01-31
+func getModerationLogs(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var filter struct {
+			UserID  uint  `form:"user_id"`
+			Blocked *bool `form:"blocked"`
+			Limit   int   `form:"limit"`
+		}
+		if err := c.ShouldBindQuery(&filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request"})
+			return
+		}
+		start, end := parseTimeRange(c)
+		if filter.Limit <= 0 || filter.Limit > 1000 {
+			filter.Limit = 100
+		}
+
+		query := db.Model(&model.ModerationLog{}).Where("time BETWEEN ? AND ?", start, end.AddDate(0, 0, 1))
+		if filter.UserID > 0 {
+			query = query.Where("user_id = ?", filter.UserID)
+		}
+		if filter.Blocked != nil {
+			query = query.Where("blocked = ?", *filter.Blocked)
+		}
+
+		var logs []ModerationLogResult
+		if err := query.Order("id desc").Limit(filter.Limit).Find(&logs).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get moderation logs"})
+			return
+		}
+		c.JSON(http.StatusOK, logs)
+	}
+}
+
+type RedactionSummaryResult struct {
+	UserId    uint   `json:"userId"`
+	Direction string `json:"direction"`
+	Type      string `json:"type"`
+	Requests  int    `json:"requests"`
+	Total     int    `json:"total"`
+}
+
+// GET /api/moderation/redactions?user_id=1&start=2024-01-01&end=2024-01-31
+func getRedactionSummary(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var filter struct {
+			UserID uint `form:"user_id"`
+		}
+		if err := c.ShouldBindQuery(&filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request"})
+			return
+		}
+		start, end := parseTimeRange(c)
+
+		query := db.Model(&model.RedactionEvent{}).Where("time BETWEEN ? AND ?", start, end.AddDate(0, 0, 1))
+		if filter.UserID > 0 {
+			query = query.Where("user_id = ?", filter.UserID)
+		}
+
+		var results []RedactionSummaryResult
+		err := query.
+			Select("user_id, direction, type, count(*) as requests, sum(count) as total").
+			Group("user_id, direction, type").
+			Find(&results).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get redaction summary"})
+			return
+		}
+		c.JSON(http.StatusOK, results)
+	}
+}
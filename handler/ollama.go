@@ -1,11 +1,25 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"safe-ollama/config"
+	"safe-ollama/metrics"
 	"safe-ollama/middleware"
+	"safe-ollama/model"
+	"safe-ollama/upstream"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,84 +27,359 @@ import (
 	"gorm.io/gorm"
 )
 
+// usage kinds a route may count
+var usageKinds = []string{model.USAGE_KIND_GENERATE, model.USAGE_KIND_CHAT, model.USAGE_KIND_COMPLETION, model.USAGE_KIND_EMBEDDING}
+
+// OllamaHandler exposes the routes of config.ProxyRoutes, any other /api or /v1 path is denied by NoRoute.
 func OllamaHandler(router *gin.Engine, db *gorm.DB) {
-	r := router.Group("")
-	chatRouter := r.Group("", middleware.OllamaAuth(db), middleware.OllamaTokenCount(db))
-	chatRouter.POST("/api/generate", forwardRequest("/api/generate"))
-	chatRouter.POST("/api/chat", forwardRequest("/api/chat"))
-	chatRouter.POST("/api/chat-stream", forwardRequest("/api/chat-stream"))
-	chatRouter.POST("/v1/chat/completions", forwardRequest("/v1/chat/completions"))
-	chatRouter.POST("/v1/completions", forwardRequest("/v1/completions"))
-	chatRouter.POST("/v1/embeddings", forwardRequest("/v1/embeddings"))
-	chatRouter.GET("/v1/models", forwardRequest("/v1/models"))
-
-	ollamaRouter := r.Group("/api", middleware.OllamaAuth(db))
-	ollamaRouter.POST("/create", forwardRequest("/api/create"))
-	ollamaRouter.GET("/tags", forwardRequest("/api/tags"))
-	ollamaRouter.POST("/show", forwardRequest("/api/show"))
-	ollamaRouter.POST("/copy", forwardRequest("/api/copy"))
-	ollamaRouter.POST("/pull", forwardRequest("/api/pull"))
-	ollamaRouter.POST("/push", forwardRequest("/api/push"))
-	ollamaRouter.POST("/embed", forwardRequest("/api/embed"))
-	ollamaRouter.POST("/embeddings", forwardRequest("/api/embeddings"))
-	ollamaRouter.GET("/ps", forwardRequest("/api/ps"))
-	ollamaRouter.DELETE("/delete", forwardRequest("/api/delete"))
-	ollamaRouter.GET("/version", forwardRequest("/api/version"))
+	moderate := middleware.Moderation(db)
+	redaction := middleware.Redaction(db)
+	cache := middleware.ResponseCache()
+	audit := middleware.Audit(db)
+
+	for _, route := range config.ProxyRoutes {
+		if !slices.Contains(model.AllScopes, route.Scope) {
+			panic(fmt.Sprintf("proxy route %s: invalid scope \"%s\"", route.Path, route.Scope))
+		}
+		if route.Count != "" && route.Count != "none" && !slices.Contains(usageKinds, route.Count) {
+			panic(fmt.Sprintf("proxy route %s: invalid count mode \"%s\"", route.Path, route.Count))
+		}
+		bodyLimit := route.BodyLimit
+		if bodyLimit == 0 {
+			bodyLimit = config.ProxyMaxBodySize
+		}
+
+		handlers := []gin.HandlerFunc{
+			middleware.BodyLimit(bodyLimit),
+			middleware.OllamaAuth(db),
+			middleware.RequireScope(route.Scope),
+			middleware.ReadBody(),
+		}
+		if translate, ok := translateRoutes[route.Path]; ok {
+			handlers = append(handlers, translate)
+		}
+		handlers = append(handlers,
+			middleware.ModelAccess(),
+			middleware.RequestPolicy(db),
+			middleware.RateLimit(),
+		)
+		// the classifier call may be slow, it must not hold a concurrency slot while it runs
+		switch route.Scope {
+		case model.SCOPE_INFERENCE:
+			handlers = append(handlers, audit, moderate)
+		case model.SCOPE_EMBEDDINGS:
+			handlers = append(handlers, audit)
+		}
+		handlers = append(handlers,
+			middleware.ConcurrencyLimit(),
+			middleware.Inflight(),
+		)
+		if slices.Contains(usageKinds, route.Count) {
+			handlers = append(handlers, middleware.OllamaTokenCount(db, route.Count))
+		}
+		switch route.Scope {
+		case model.SCOPE_INFERENCE:
+			handlers = append(handlers, redaction, cache)
+		case model.SCOPE_EMBEDDINGS:
+			handlers = append(handlers, cache)
+		}
+		handlers = append(handlers, forwardRequest(route))
+
+		for _, method := range route.Methods {
+			router.Handle(strings.ToUpper(method), route.Path, handlers...)
+		}
+	}
 }
 
 var (
+	// timeouts depend on the route, see upstreamDeadline
 	httpClient = &http.Client{
-		Timeout: 60 * time.Second,
 		Transport: &http.Transport{
+			DialContext:         dialContext,
 			MaxIdleConns:        200,
 			MaxIdleConnsPerHost: 10,
 			IdleConnTimeout:     time.Duration(config.OllamaTimeout) * time.Second,
 		},
 	}
-	rateLimiter = make(chan struct{}, 200)
-	mu          sync.Mutex
+
+	upstreamRetries = metrics.NewCounter("safe_ollama_upstream_retries_total",
+		"Retry decisions after upstream connection errors: retry, failover or give_up.", "class", "decision")
+
+	// model listings filtered by the allowlists of the caller
+	listRoutes = map[string]bool{
+		"/api/tags":  true,
+		"/api/ps":    true,
+		"/v1/models": true,
+	}
+
+	// routes speaking another API, translated from and to the Ollama API of their upstream path
+	translateRoutes = map[string]gin.HandlerFunc{
+		"/v1/messages":  middleware.AnthropicMessages(),
+		"/v1/responses": middleware.OpenAIResponses(),
+	}
 )
 
-func forwardRequest(path string) func(c *gin.Context) {
-	return func(c *gin.Context) {
-		url := config.OllamaHost + path
-		req, err := http.NewRequest(c.Request.Method, url, c.Request.Body)
+// model management routes that act on an existing model, with the field naming it when it is not "model"
+var existingModelRoutes = map[string]string{
+	"/api/delete": "",
+	"/api/copy":   "source",
+	"/api/push":   "",
+}
+
+// routeModel returns the model that decides the backend of a request, or false to use any backend: other
+// model management requests create models that may not exist yet.
+func routeModel(c *gin.Context, route config.ProxyRoute) (string, bool) {
+	field, existing := existingModelRoutes[route.Path]
+	if route.Scope == model.SCOPE_MODELS_WRITE && !existing {
+		return "", false
+	}
+	if field == "" {
+		return middleware.RequestModel(c), true
+	}
+	body, _ := middleware.RequestBody(c)
+	var data map[string]any
+	_ = json.Unmarshal(body, &data)
+	name, _ := data[field].(string)
+	return name, true
+}
+
+// pick selects the backend for a request. A backend it returns has been admitted by its circuit breaker,
+// so the request must end in recordResult.
+func pick(c *gin.Context, route config.ProxyRoute, exclude []*upstream.Backend) (*upstream.Admission, error) {
+	if name, ok := routeModel(c, route); ok {
+		return upstream.PickForModel(name, exclude...)
+	}
+	return upstream.Pick(exclude...)
+}
+
+func pickBackend(c *gin.Context, route config.ProxyRoute, exclude []*upstream.Backend) (*upstream.Admission, bool) {
+	backend, err := pick(c, route, exclude)
+	var circuitOpen *upstream.CircuitOpenError
+	switch {
+	case errors.As(err, &circuitOpen):
+		abortCircuitOpen(c, circuitOpen)
+		return nil, false
+	case err != nil:
+		middleware.AbortWithError(c, http.StatusServiceUnavailable, "backend_unavailable", err.Error())
+		return nil, false
+	}
+	return backend, true
+}
+
+// outcome of an upstream request, fed into the circuit breaker of its backend
+const (
+	resultOK = iota
+	resultFailed
+	resultCancelled
+)
+
+func recordResult(backend *upstream.Admission, result int) {
+	if result == resultCancelled {
+		backend.RecordCancelled()
+	} else {
+		backend.RecordResult(result == resultOK)
+	}
+}
+
+// sendUpstream sends the request to a backend. Failures to connect are retried with backoff, on another backend
+// if there is one, which is safe because neither Ollama nor the client has seen anything yet. On failure the error
+// response has been written and ok is false, otherwise the caller must call done once the response is read.
+func sendUpstream(c *gin.Context, route config.ProxyRoute) (resp *http.Response, deadline *upstreamDeadline, done func(result int), ok bool) {
+	body, err := middleware.RequestBody(c)
+	if err != nil {
+		middleware.AbortWithError(c, http.StatusBadRequest, "invalid_request", "failed to read request body")
+		return nil, nil, nil, false
+	}
+	class, timeout := routeTimeout(route)
+	// a raw body can only be sent once
+	retries := config.OllamaRetryAttempts
+	if middleware.RawBody(c) {
+		retries = 0
+	}
+
+	var tried []*upstream.Backend
+	backend, ok := pickBackend(c, route, nil)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	for attempt := 1; ; attempt++ {
+		release := backend.Acquire()
+		middleware.SetInflightBackend(c, backend.URL)
+		deadline = newUpstreamDeadline(c.Request.Context(), timeout)
+
+		path := c.Request.URL.Path
+		if route.Upstream != "" {
+			path = route.Upstream
+		}
+		url := backend.URL + path
+		if c.Request.URL.RawQuery != "" {
+			url += "?" + c.Request.URL.RawQuery
+		}
+		// bound to the client, so Ollama stops generating when the client goes away or an admin cancels
+		req, err := http.NewRequestWithContext(deadline.ctx, c.Request.Method, url, bytes.NewReader(body))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
-			return
+			deadline.release()
+			release()
+			recordResult(backend, resultCancelled)
+			middleware.AbortWithError(c, http.StatusInternalServerError, "internal_error", "failed to create request")
+			return nil, nil, nil, false
+		}
+		if middleware.RawBody(c) {
+			req.Body = c.Request.Body
+			req.ContentLength = c.Request.ContentLength
+			// the stream cannot be rewound, a redirect must not resend the empty reader of the buffered body
+			req.GetBody = nil
+		} else if len(body) == 0 {
+			req.Body = http.NoBody
 		}
 
 		header := c.Request.Header.Clone()
 		header.Del("Authorization")
+		header.Del("X-Api-Key")
 		req.Header = header
 
-		mu.Lock()
-		select {
-		case rateLimiter <- struct{}{}:
-			defer func() {
-				<-rateLimiter // 归还令牌
-				mu.Unlock()
-			}()
+		resp, err = httpClient.Do(req)
+		if err == nil {
+			return resp, deadline, func(result int) {
+				deadline.release()
+				release()
+				recordResult(backend, result)
+				// before the handler returns, so that the client can use a new model as soon as its response ends
+				if route.Scope == model.SCOPE_MODELS_WRITE && result == resultOK && resp.StatusCode < 300 &&
+					config.OllamaInventoryInterval > 0 {
+					backend.RefreshInventory()
+				}
+			}, true
+		}
+		te := deadline.exceeded(err)
+		deadline.release()
+		release()
+
+		switch {
+		case c.Request.Context().Err() != nil:
+			backend.RecordCancelled()
+			middleware.SetUsageStatus(c, model.USAGE_STATUS_CANCELLED)
+			abortCancelled(c)
+			return nil, nil, nil, false
+		case te != nil:
+			upstreamTimeouts.Inc(class, te.name)
+			slog.Warn("[Ollama] upstream request timed out", "url", url, "timeout", te.name, "limit", te.limit)
+			backend.RecordResult(false)
+			// Ollama may already be working on a request that timed out after it was sent
+			if te.name != "connect" {
+				middleware.SetUsageStatus(c, model.USAGE_STATUS_TIMEOUT)
+				middleware.AbortWithError(c, http.StatusGatewayTimeout, "upstream_timeout", "Ollama did not respond: "+te.Error())
+				return nil, nil, nil, false
+			}
 		default:
-			mu.Unlock()
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many requests"})
-			return
+			backend.RecordResult(false)
+			// once connected the request may have reached Ollama, sending it again could repeat a delete,
+			// a pull or a generation
+			if !isConnectError(err) {
+				upstreamRetries.Inc(class, "give_up")
+				slog.Error("[Ollama] upstream request failed after it was sent, not retrying", "url", url, "error", err)
+				middleware.AbortWithError(c, http.StatusBadGateway, "upstream_error", "failed to communicate with API")
+				return nil, nil, nil, false
+			}
 		}
 
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to communicate with API"})
+		if attempt > retries {
+			upstreamRetries.Inc(class, "give_up")
+			slog.Error("[Ollama] upstream request failed, giving up", "url", url, "attempts", attempt, "error", err)
+			if te != nil {
+				middleware.AbortWithError(c, http.StatusGatewayTimeout, "upstream_timeout", "Ollama did not respond: "+te.Error())
+			} else {
+				middleware.AbortWithError(c, http.StatusBadGateway, "upstream_error", "failed to communicate with API")
+			}
+			return nil, nil, nil, false
+		}
+
+		if !sleepBackoff(c.Request.Context(), attempt) {
+			middleware.SetUsageStatus(c, model.USAGE_STATUS_CANCELLED)
+			abortCancelled(c)
+			return nil, nil, nil, false
+		}
+		tried = append(tried, backend.Backend)
+		next, pickErr := pick(c, route, tried)
+		if pickErr != nil && !errors.As(pickErr, new(*upstream.CircuitOpenError)) {
+			// every other backend is down or lacks the model, try the ones already tried again, whose
+			// breakers may have opened meanwhile
+			next, pickErr = pick(c, route, nil)
+		}
+		var circuitOpen *upstream.CircuitOpenError
+		if errors.As(pickErr, &circuitOpen) {
+			upstreamRetries.Inc(class, "give_up")
+			slog.Error("[Ollama] upstream request failed, circuit open", "url", url, "attempts", attempt, "error", err)
+			abortCircuitOpen(c, circuitOpen)
+			return nil, nil, nil, false
+		}
+		if pickErr != nil {
+			upstreamRetries.Inc(class, "give_up")
+			slog.Error("[Ollama] upstream request failed, no backend left", "url", url, "attempts", attempt, "error", pickErr)
+			middleware.AbortWithError(c, http.StatusBadGateway, "upstream_error", "failed to communicate with API")
+			return nil, nil, nil, false
+		}
+		decision := "failover"
+		if next.Backend == backend.Backend {
+			decision = "retry"
+		}
+		upstreamRetries.Inc(class, decision)
+		slog.Warn("[Ollama] upstream request failed, retrying", "decision", decision, "url", url, "next", next.URL,
+			"attempt", attempt, "error", err)
+		backend = next
+	}
+}
+
+// sleepBackoff waits before the next attempt with exponential backoff and jitter, it returns false if the
+// client went away in the meantime.
+func sleepBackoff(ctx context.Context, attempt int) bool {
+	backoff := time.Duration(config.OllamaRetryBackoff) * time.Millisecond << (attempt - 1)
+	if limit := time.Duration(config.OllamaRetryMaxBackoff) * time.Millisecond; backoff > limit {
+		backoff = limit
+	}
+	if backoff > 0 {
+		backoff = backoff/2 + rand.N(backoff/2+1)
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func forwardRequest(route config.ProxyRoute) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if listRoutes[route.Path] {
+			listModels(c, route)
 			return
 		}
+		resp, deadline, done, ok := sendUpstream(c, route)
+		if !ok {
+			return
+		}
+		result := resultOK
+		defer func() {
+			done(result)
+		}()
+		class, _ := routeTimeout(route)
+		url := resp.Request.URL.String()
 		defer func(Body io.ReadCloser) {
 			_ = Body.Close()
 		}(resp.Body)
+		deadline.received()
 
-		slog.Debug("[Ollama]", "url", req.URL, "status", resp.StatusCode, "headers", resp.Header)
+		slog.Debug("[Ollama]", "url", url, "status", resp.StatusCode, "headers", resp.Header)
 
-		if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			if resp.StatusCode >= http.StatusInternalServerError {
+				result = resultFailed
+			}
+			middleware.SetUsageStatus(c, model.USAGE_STATUS_UPSTREAM_ERROR)
 			body, _ := io.ReadAll(resp.Body)
-			c.JSON(resp.StatusCode, gin.H{"error": string(body)})
+			middleware.AbortWithUpstreamError(c, resp.StatusCode, body)
 			return
 		}
 
@@ -102,10 +391,142 @@ func forwardRequest(path string) func(c *gin.Context) {
 
 		c.Status(resp.StatusCode)
 
-		_, err = io.Copy(c.Writer, resp.Body)
+		err := copyResponse(c.Writer, resp.Body, deadline.received)
 		if err != nil {
+			// the response is incomplete, later middlewares must not treat it as a result
+			c.Abort()
+			switch te := deadline.exceeded(err); {
+			case c.Request.Context().Err() != nil:
+				result = resultCancelled
+				middleware.SetUsageStatus(c, model.USAGE_STATUS_CANCELLED)
+				return
+			case te != nil:
+				result = resultFailed
+				// the status line is gone already, the client only sees the stream end
+				upstreamTimeouts.Inc(class, te.name)
+				slog.Warn("[Ollama] upstream stream timed out", "url", url, "timeout", te.name, "limit", te.limit)
+				middleware.SetUsageStatus(c, model.USAGE_STATUS_TIMEOUT)
+				return
+			default:
+				result = resultFailed
+				middleware.SetUsageStatus(c, model.USAGE_STATUS_UPSTREAM_ERROR)
+			}
 			slog.Error("error during copying response body", "error", err)
 			return
 		}
 	}
 }
+
+// abortCircuitOpen fails fast while every backend that could serve the request is considered broken.
+func abortCircuitOpen(c *gin.Context, err *upstream.CircuitOpenError) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	middleware.AbortWithError(c, http.StatusServiceUnavailable, "circuit_open", err.Error())
+}
+
+// abortCancelled answers a request cancelled before Ollama responded, only admins leave a client to answer.
+func abortCancelled(c *gin.Context) {
+	if middleware.CancelledByAdmin(c) {
+		middleware.AbortWithError(c, http.StatusServiceUnavailable, "request_cancelled", "request was cancelled by an administrator")
+	} else {
+		c.Abort()
+	}
+}
+
+// isConnectError reports whether err happened while connecting, before any of the request was sent.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// copyResponse writes the upstream body through to the client, flushing after every read so streamed
+// frames are delivered as soon as Ollama produces them.
+func copyResponse(w gin.ResponseWriter, body io.Reader, onRead func()) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			onRead()
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			w.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// listModels answers a model listing with the models of every available backend, filtered by the allowlists
+// of the caller. Backends that fail to answer are left out.
+func listModels(c *gin.Context, route config.ProxyRoute) {
+	backends := upstream.Available()
+	if len(backends) == 0 {
+		middleware.AbortWithError(c, http.StatusServiceUnavailable, "backend_unavailable", upstream.ErrNoBackend.Error())
+		return
+	}
+	_, timeout := routeTimeout(route)
+	bodies := make([][]byte, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := fetchList(c, backend, timeout)
+			if err != nil {
+				slog.Warn("[Ollama] fail to list models", "url", backend.URL, "error", err)
+				return
+			}
+			bodies[i] = body
+		}()
+	}
+	wg.Wait()
+
+	bodies = slices.DeleteFunc(bodies, func(body []byte) bool { return body == nil })
+	if len(bodies) == 0 {
+		middleware.AbortWithError(c, http.StatusBadGateway, "upstream_error", "failed to communicate with API")
+		return
+	}
+	body, err := middleware.MergeModelLists(bodies)
+	if err == nil {
+		body, err = middleware.FilterModelList(c, body)
+	}
+	if err != nil {
+		slog.Error("[Ollama] fail to filter model list", "error", err)
+		middleware.AbortWithError(c, http.StatusBadGateway, "upstream_error", "failed to read model list")
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+func fetchList(c *gin.Context, backend *upstream.Backend, timeout config.RouteTimeout) ([]byte, error) {
+	release := backend.Acquire()
+	defer release()
+	deadline := newUpstreamDeadline(c.Request.Context(), timeout)
+	defer deadline.release()
+
+	req, err := http.NewRequestWithContext(deadline.ctx, http.MethodGet, backend.URL+c.Request.URL.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	deadline.received()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"safe-ollama/config"
+	"safe-ollama/upstream"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func deadURL(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	_ = l.Close()
+	return url
+}
+
+// Failing over away from dead backends must leave no circuit breaker waiting for a trial result that never
+// comes, otherwise the backend is stuck half open and never picked again.
+func TestRetryFailoverReleasesBreakerTrials(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"version":"0.0.0"}`))
+	}))
+	defer live.Close()
+
+	config.OllamaBackends = []config.OllamaBackend{{URL: deadURL(t), Weight: 1}, {URL: deadURL(t), Weight: 1}, {URL: deadURL(t), Weight: 1}, {URL: live.URL, Weight: 1}}
+	config.OllamaBalance = upstream.RoundRobin
+	config.OllamaHealthInterval = 0
+	config.OllamaInventoryInterval = 0
+	config.OllamaRetryAttempts = 3
+	config.OllamaRetryBackoff = 0
+	config.OllamaRetryMaxBackoff = 0
+	config.OllamaBreakerFailureThreshold = 1
+	// open circuits may be retried at once, so that every pick can admit a trial
+	config.OllamaBreakerOpenDuration = 0
+	config.OllamaBreakerHalfOpenRequests = 1
+	upstream.Init()
+
+	route := config.ProxyRoute{Path: "/api/version", Methods: []string{"GET"}, Scope: "models:read"}
+	router := gin.New()
+	router.GET(route.Path, forwardRequest(route))
+
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, route.Path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, body %s", i, w.Code, w.Body.String())
+		}
+		// every request is done, a trial still counted means it leaked
+		for _, b := range upstream.Backends() {
+			if b.Circuit == upstream.BreakerHalfOpen {
+				t.Fatalf("request %d: backend %s left half open", i, b.URL)
+			}
+		}
+	}
+}
+
+// A connection dropped after the request was sent must not be retried, Ollama may already have run it.
+func TestDroppedConnectionIsNotRetried(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var received atomic.Int32
+	dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		received.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+	defer dropping.Close()
+
+	config.OllamaBackends = []config.OllamaBackend{{URL: dropping.URL, Weight: 1}}
+	config.OllamaBalance = upstream.RoundRobin
+	config.OllamaHealthInterval = 0
+	config.OllamaInventoryInterval = 0
+	config.OllamaRetryAttempts = 3
+	config.OllamaRetryBackoff = 0
+	config.OllamaRetryMaxBackoff = 0
+	config.OllamaBreakerFailureThreshold = 0
+	upstream.Init()
+
+	route := config.ProxyRoute{Path: "/api/pull", Methods: []string{"POST"}, Scope: "models:write"}
+	router := gin.New()
+	router.POST(route.Path, forwardRequest(route))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, route.Path, strings.NewReader(`{"model":"llama3"}`)))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, body %s", w.Code, w.Body.String())
+	}
+	if n := received.Load(); n != 1 {
+		t.Fatalf("backend received the request %d times, want 1", n)
+	}
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"safe-ollama/middleware"
+	"safe-ollama/model"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func RequestPolicyHandler(router *gin.Engine, db *gorm.DB) {
+	r := router.Group("/api/request_policy", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	r.GET("/", getRequestPolicies(db))
+	r.POST("/", createRequestPolicy(db))
+	r.PUT("/:id", updateRequestPolicy(db))
+	r.DELETE("/:id", deleteRequestPolicy(db))
+}
+
+type PolicyBean struct {
+	Role         string `json:"role"`
+	UserId       uint   `json:"userId"`
+	Action       string `json:"action"`
+	MaxNumCtx    int    `json:"maxNumCtx"`
+	MaxPredict   int    `json:"maxPredict"`
+	MaxKeepAlive int    `json:"maxKeepAlive"`
+	MaxImages    int    `json:"maxImages"`
+}
+
+type PolicyResult struct {
+	ID           uint   `json:"id"`
+	Role         string `json:"role"`
+	UserId       uint   `json:"userId"`
+	Action       string `json:"action"`
+	MaxNumCtx    int    `json:"maxNumCtx"`
+	MaxPredict   int    `json:"maxPredict"`
+	MaxKeepAlive int    `json:"maxKeepAlive"`
+	MaxImages    int    `json:"maxImages"`
+}
+
+func toPolicyResult(policy model.RequestPolicy) PolicyResult {
+	return PolicyResult{
+		ID:           policy.ID,
+		Role:         policy.Role,
+		UserId:       policy.UserId,
+		Action:       policy.Action,
+		MaxNumCtx:    policy.MaxNumCtx,
+		MaxPredict:   policy.MaxPredict,
+		MaxKeepAlive: policy.MaxKeepAlive,
+		MaxImages:    policy.MaxImages,
+	}
+}
+
+func (b *PolicyBean) validate() string {
+	if (b.Role == "") == (b.UserId == 0) {
+		return "Exactly one of role and userId must be set"
+	}
+	if b.Role != "" && b.Role != model.ADMIN_ROLE && b.Role != model.USER_ROLE {
+		return "Unknown role: " + b.Role
+	}
+	if b.Action == "" {
+		b.Action = model.POLICY_CLAMP
+	}
+	if b.Action != model.POLICY_CLAMP && b.Action != model.POLICY_REJECT {
+		return "Action must be clamp or reject"
+	}
+	if b.MaxNumCtx < 0 || b.MaxPredict < 0 || b.MaxKeepAlive < 0 || b.MaxImages < 0 {
+		return "Limits cannot be negative"
+	}
+	return ""
+}
+
+func (b *PolicyBean) apply(policy *model.RequestPolicy) {
+	policy.Role = b.Role
+	policy.UserId = b.UserId
+	policy.Action = b.Action
+	policy.MaxNumCtx = b.MaxNumCtx
+	policy.MaxPredict = b.MaxPredict
+	policy.MaxKeepAlive = b.MaxKeepAlive
+	policy.MaxImages = b.MaxImages
+}
+
+func getRequestPolicies(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var policies []PolicyResult
+		if err := db.Model(&model.RequestPolicy{}).Find(&policies).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get policies"})
+			return
+		}
+		c.JSON(http.StatusOK, policies)
+	}
+}
+
+func createRequestPolicy(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var policyBean PolicyBean
+		if err := c.ShouldBindJSON(&policyBean); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		if msg := policyBean.validate(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		var policy model.RequestPolicy
+		policyBean.apply(&policy)
+		if err := db.Create(&policy).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create policy"})
+			return
+		}
+		c.JSON(http.StatusCreated, toPolicyResult(policy))
+	}
+}
+
+func updateRequestPolicy(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var policyBean PolicyBean
+		if err := c.ShouldBindJSON(&policyBean); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		if msg := policyBean.validate(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		var policy model.RequestPolicy
+		if err := db.First(&policy, c.Param("id")).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update policy"})
+			return
+		}
+		policyBean.apply(&policy)
+		if err := db.Save(&policy).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update policy"})
+			return
+		}
+		c.JSON(http.StatusOK, toPolicyResult(policy))
+	}
+}
+
+func deleteRequestPolicy(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var policy model.RequestPolicy
+		if err := db.First(&policy, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+			return
+		}
+		if err := db.Delete(&policy).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete policy"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Policy deleted successfully"})
+	}
+}
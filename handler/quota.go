@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"safe-ollama/middleware"
+	"safe-ollama/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TokenQuotaHandler(router *gin.Engine, db *gorm.DB) {
+	// 持有 API token 的用户查询自己的剩余额度
+	router.GET("/api/quota", middleware.OllamaTokenAuth(db), getQuotaStatus(db))
+
+	r := router.Group("/api/token_quota", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	r.GET("/", getTokenQuotas(db))
+	r.POST("/", createTokenQuota(db))
+	r.PUT("/:id", updateTokenQuota(db))
+	r.DELETE("/:id", deleteTokenQuota(db))
+}
+
+type QuotaBean struct {
+	UserId        uint   `json:"userId"`
+	Model         string `json:"model"`
+	Period        string `json:"period"`
+	PromptLimit   int    `json:"promptLimit"`
+	ResponseLimit int    `json:"responseLimit"`
+	TotalLimit    int    `json:"totalLimit"`
+}
+
+type QuotaResult struct {
+	ID            uint      `json:"id"`
+	UserId        uint      `json:"userId"`
+	OllamaModel   string    `json:"model"`
+	Period        string    `json:"period"`
+	PromptLimit   int       `json:"promptLimit"`
+	ResponseLimit int       `json:"responseLimit"`
+	TotalLimit    int       `json:"totalLimit"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+func toQuotaResult(quota model.TokenQuota) QuotaResult {
+	return QuotaResult{
+		ID:            quota.ID,
+		UserId:        quota.UserId,
+		OllamaModel:   quota.OllamaModel,
+		Period:        quota.Period,
+		PromptLimit:   quota.PromptLimit,
+		ResponseLimit: quota.ResponseLimit,
+		TotalLimit:    quota.TotalLimit,
+		CreatedAt:     quota.CreatedAt,
+	}
+}
+
+func (b *QuotaBean) validate() string {
+	switch b.Period {
+	case model.QUOTA_DAILY, model.QUOTA_WEEKLY, model.QUOTA_MONTHLY:
+	default:
+		return "Period must be one of daily, weekly, monthly"
+	}
+	if b.PromptLimit < 0 || b.ResponseLimit < 0 || b.TotalLimit < 0 {
+		return "Limits cannot be negative"
+	}
+	if b.PromptLimit == 0 && b.ResponseLimit == 0 && b.TotalLimit == 0 {
+		return "At least one limit must be set"
+	}
+	return ""
+}
+
+// GET /api/quota
+func getQuotaStatus(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(model.User)
+		statuses, err := middleware.GetQuotaStatus(db, user.ID)
+		if err != nil {
+			slog.Error("[Quota] fail to get quota status", "error", err)
+			middleware.AbortWithError(c, http.StatusInternalServerError, "internal_error", "failed to get quota status")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"quotas": statuses})
+	}
+}
+
+// GET /api/token_quota?user_id=1
+func getTokenQuotas(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var quotas []QuotaResult
+		query := db.Model(&model.TokenQuota{})
+		if userId := c.Query("user_id"); userId != "" {
+			query = query.Where("user_id = ?", userId)
+		}
+		if err := query.Find(&quotas).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get quotas"})
+			return
+		}
+		c.JSON(http.StatusOK, quotas)
+	}
+}
+
+func createTokenQuota(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var quotaBean QuotaBean
+		if err := c.ShouldBindJSON(&quotaBean); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		if msg := quotaBean.validate(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		if err := db.First(&model.User{}, quotaBean.UserId).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		quota := model.TokenQuota{
+			UserId:        quotaBean.UserId,
+			OllamaModel:   quotaBean.Model,
+			Period:        quotaBean.Period,
+			PromptLimit:   quotaBean.PromptLimit,
+			ResponseLimit: quotaBean.ResponseLimit,
+			TotalLimit:    quotaBean.TotalLimit,
+		}
+		if err := db.Create(&quota).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create quota"})
+			return
+		}
+		c.JSON(http.StatusCreated, toQuotaResult(quota))
+	}
+}
+
+func updateTokenQuota(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var quotaBean QuotaBean
+		if err := c.ShouldBindJSON(&quotaBean); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		if msg := quotaBean.validate(); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+
+		var quota model.TokenQuota
+		if err := db.First(&quota, c.Param("id")).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Quota not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+			return
+		}
+		quota.OllamaModel = quotaBean.Model
+		quota.Period = quotaBean.Period
+		quota.PromptLimit = quotaBean.PromptLimit
+		quota.ResponseLimit = quotaBean.ResponseLimit
+		quota.TotalLimit = quotaBean.TotalLimit
+		if err := db.Save(&quota).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+			return
+		}
+		c.JSON(http.StatusOK, toQuotaResult(quota))
+	}
+}
+
+func deleteTokenQuota(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var quota model.TokenQuota
+		if err := db.First(&quota, c.Param("id")).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Quota not found"})
+			return
+		}
+		if err := db.Delete(&quota).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quota"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Quota deleted successfully"})
+	}
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"safe-ollama/config"
+	"safe-ollama/metrics"
+	"time"
+)
+
+var upstreamTimeouts = metrics.NewCounter("safe_ollama_upstream_timeouts_total",
+	"Upstream requests aborted by a timeout.", "class", "timeout")
+
+func routeTimeout(route config.ProxyRoute) (string, config.RouteTimeout) {
+	class := route.Timeout
+	if _, ok := config.OllamaTimeouts[class]; !ok {
+		class = "default"
+	}
+	return class, config.OllamaTimeouts[class]
+}
+
+// timeoutError names the timeout that aborted an upstream request.
+type timeoutError struct {
+	name  string
+	limit time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timeout of %s exceeded", e.name, e.limit)
+}
+
+type connectTimeoutKey struct{}
+
+// dialContext applies the connect timeout of the route, carried by the request context.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{KeepAlive: 30 * time.Second}
+	if timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		dialer.Timeout = timeout
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil && isTimeout(err) {
+		return nil, &timeoutError{name: "connect", limit: dialer.Timeout}
+	}
+	return conn, err
+}
+
+// upstreamDeadline cancels an upstream request when no response arrives within first_byte, when a stream
+// stalls for longer than idle, or when the whole request exceeds total.
+type upstreamDeadline struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   context.CancelFunc
+	timer  *time.Timer
+	idle   time.Duration
+	// the first byte has arrived
+	streaming bool
+}
+
+func newUpstreamDeadline(parent context.Context, timeout config.RouteTimeout) *upstreamDeadline {
+	ctx := context.WithValue(parent, connectTimeoutKey{}, time.Duration(timeout.Connect)*time.Second)
+	stop := context.CancelFunc(func() {})
+	if timeout.Total > 0 {
+		limit := time.Duration(timeout.Total) * time.Second
+		ctx, stop = context.WithTimeoutCause(ctx, limit, &timeoutError{name: "total", limit: limit})
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	d := &upstreamDeadline{ctx: ctx, cancel: cancel, stop: stop, idle: time.Duration(timeout.Idle) * time.Second}
+	if timeout.FirstByte > 0 {
+		limit := time.Duration(timeout.FirstByte) * time.Second
+		d.timer = time.AfterFunc(limit, func() {
+			cancel(&timeoutError{name: "first_byte", limit: limit})
+		})
+	}
+	return d
+}
+
+// received switches from the first byte timeout to the idle timeout, it is called after every read.
+func (d *upstreamDeadline) received() {
+	if d.streaming {
+		if d.timer != nil {
+			d.timer.Reset(d.idle)
+		}
+		return
+	}
+	d.streaming = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.idle > 0 {
+		limit := d.idle
+		d.timer = time.AfterFunc(limit, func() {
+			d.cancel(&timeoutError{name: "idle", limit: limit})
+		})
+	}
+}
+
+// exceeded returns the timeout that aborted the request, if any.
+func (d *upstreamDeadline) exceeded(err error) *timeoutError {
+	if te, ok := context.Cause(d.ctx).(*timeoutError); ok {
+		return te
+	}
+	var te *timeoutError
+	if errors.As(err, &te) {
+		return te
+	}
+	return nil
+}
+
+func (d *upstreamDeadline) release() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel(nil)
+	d.stop()
+}
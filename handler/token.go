@@ -16,13 +16,25 @@ func OllamaTokenHandler(router *gin.Engine, db *gorm.DB) {
 	r.GET("/", getOllamaToken(db))
 	r.POST("/", createOllamaToken(db))
 	r.DELETE("/:tokenId", deleteOllamaToken(db))
+
+	admin := router.Group("/api/token/admin", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	admin.GET("/", getAllOllamaToken(db))
+	admin.PUT("/:tokenId", updateOllamaTokenLimit(db))
 }
 
 type TokenResult struct {
-	ID        uint      `json:"id"`
-	Name      string    `json:"name"`
-	Token     string    `json:"token"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID                uint      `json:"id"`
+	Name              string    `json:"name"`
+	Token             string    `json:"token"`
+	UserId            uint      `json:"userId"`
+	CreatedAt         time.Time `json:"createdAt"`
+	MaxConcurrent     int       `json:"maxConcurrent"`
+	RequestsPerMinute int       `json:"requestsPerMinute"`
+	TokensPerMinute   int       `json:"tokensPerMinute"`
+	TokensPerHour     int       `json:"tokensPerHour"`
+	AllowedModels     []string  `json:"allowedModels" gorm:"serializer:json"`
+	Scopes            []string  `json:"scopes" gorm:"serializer:json"`
+	AuditEnabled      bool      `json:"auditEnabled"`
 }
 
 func getOllamaToken(db *gorm.DB) gin.HandlerFunc {
@@ -46,6 +58,29 @@ func getOllamaToken(db *gorm.DB) gin.HandlerFunc {
 
 type CreateBean struct {
 	Name string `json:"name"`
+	// narrows the token to a subset of the models of the user
+	AllowedModels []string `json:"allowedModels"`
+	// defaults to model.DefaultScopes, only admins may grant models:write
+	Scopes []string `json:"scopes"`
+}
+
+func validateScopes(scopes []string, role string) (int, string) {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range model.AllScopes {
+			if s == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return http.StatusBadRequest, "Unknown scope: " + scope
+		}
+		if scope == model.SCOPE_MODELS_WRITE && role != model.ADMIN_ROLE {
+			return http.StatusForbidden, "Only admins can create tokens with the models:write scope"
+		}
+	}
+	return http.StatusOK, ""
 }
 
 func createOllamaToken(db *gorm.DB) gin.HandlerFunc {
@@ -56,6 +91,7 @@ func createOllamaToken(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 		userId := claims.(model.JwtPayload).UserId
+		role := claims.(model.JwtPayload).Role
 		var createBean CreateBean
 		err := c.BindJSON(&createBean)
 		if err != nil {
@@ -68,14 +104,25 @@ func createOllamaToken(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		scopes := createBean.Scopes
+		if len(scopes) == 0 {
+			scopes = model.DefaultScopes
+		}
+		if status, msg := validateScopes(scopes, role); msg != "" {
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+
 		// 生成随机字符串作为token
 		token := utils.GenerateToken(32)
 
 		// 创建新的OllamaToken实例
 		newToken := model.OllamaToken{
-			Token:  token,
-			Name:   name,
-			UserId: userId,
+			Token:         token,
+			Name:          name,
+			UserId:        userId,
+			AllowedModels: createBean.AllowedModels,
+			Scopes:        scopes,
 		}
 
 		// 保存到数据库
@@ -117,3 +164,74 @@ func deleteOllamaToken(db *gorm.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"message": "Token deleted successfully"})
 	}
 }
+
+func getAllOllamaToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var tokens []TokenResult
+		query := db.Model(&model.OllamaToken{})
+		if userId := c.Query("user_id"); userId != "" {
+			query = query.Where("user_id = ?", userId)
+		}
+		if err := query.Find(&tokens).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get tokens"})
+			return
+		}
+
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+type TokenLimitBean struct {
+	MaxConcurrent     *int      `json:"maxConcurrent"`
+	RequestsPerMinute *int      `json:"requestsPerMinute"`
+	TokensPerMinute   *int      `json:"tokensPerMinute"`
+	TokensPerHour     *int      `json:"tokensPerHour"`
+	AllowedModels     *[]string `json:"allowedModels"`
+	AuditEnabled      *bool     `json:"auditEnabled"`
+}
+
+func updateOllamaTokenLimit(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var limitBean TokenLimitBean
+		if err := c.ShouldBindJSON(&limitBean); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		var token model.OllamaToken
+		if err := db.First(&token, c.Param("tokenId")).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update token"})
+			return
+		}
+
+		if limitBean.MaxConcurrent != nil {
+			token.MaxConcurrent = *limitBean.MaxConcurrent
+		}
+		if limitBean.RequestsPerMinute != nil {
+			token.RequestsPerMinute = *limitBean.RequestsPerMinute
+		}
+		if limitBean.TokensPerMinute != nil {
+			token.TokensPerMinute = *limitBean.TokensPerMinute
+		}
+		if limitBean.TokensPerHour != nil {
+			token.TokensPerHour = *limitBean.TokensPerHour
+		}
+		if limitBean.AllowedModels != nil {
+			token.AllowedModels = *limitBean.AllowedModels
+		}
+		if limitBean.AuditEnabled != nil {
+			token.AuditEnabled = *limitBean.AuditEnabled
+		}
+
+		if err := db.Save(&token).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Token updated successfully"})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"safe-ollama/middleware"
 	"safe-ollama/model"
+	"safe-ollama/upstream"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -51,7 +52,7 @@ func GetUserDailyUsage(db *gorm.DB) gin.HandlerFunc {
 
 		err := db.Model(&model.TokenUsage{}).
 			Select("DATE(time) as date, SUM(prompt_eval_count) as prompt_tokens, SUM(eval_count) as response_tokens").
-			Where("user_id = ? AND time BETWEEN ? AND ?", userID, start, end).
+			Where("user_id = ? AND cached = ? AND time BETWEEN ? AND ?", userID, false, start, end).
 			Group("date").
 			Find(&results).Error
 
@@ -76,7 +77,7 @@ func GetUserUsage(db *gorm.DB) gin.HandlerFunc {
 				"count(*) as api_call_count, "+
 				"sum(prompt_eval_count) as prompt_tokens, "+
 				"sum(eval_count) as response_tokens").
-			Where("user_id = ? AND time BETWEEN ? AND ?", userID, start, end).
+			Where("user_id = ? AND cached = ? AND time BETWEEN ? AND ?", userID, false, start, end).
 			Group("ollama_model")
 
 		if err := query.Find(&results).Error; err != nil {
@@ -102,8 +103,9 @@ func GetUserModelUsage(db *gorm.DB) gin.HandlerFunc {
 				"count(*) as api_call_count, "+
 				"sum(prompt_eval_count) as prompt_tokens, "+
 				"sum(eval_count) as response_tokens").
-			Where("user_id = ? AND ollama_model = ? AND time BETWEEN ? AND ?",
-				userID, _model, start, end).
+			// rows are recorded with the tag, older ones as the client named the model
+			Where("user_id = ? AND (ollama_model = ? OR ollama_model = ?) AND cached = ? AND time BETWEEN ? AND ?",
+				userID, _model, upstream.NormalizeModel(_model), false, start, end).
 			First(&result).Error
 
 		if err != nil {
@@ -130,9 +132,9 @@ func GetSystemUsage(db *gorm.DB) gin.HandlerFunc {
 		}
 		start, end := parseTimeRange(c)
 
-		query := db.Model(&model.TokenUsage{})
+		query := db.Model(&model.TokenUsage{}).Where("cached = ?", false)
 		if filter.Model != "" {
-			query = query.Where("ollama_model = ?", filter.Model)
+			query = query.Where("ollama_model = ? OR ollama_model = ?", filter.Model, upstream.NormalizeModel(filter.Model))
 		}
 		if filter.UserID > 0 {
 			query = query.Where("user_id = ?", filter.UserID)
@@ -0,0 +1,22 @@
+package handler
+
+import (
+	"net/http"
+	"safe-ollama/middleware"
+	"safe-ollama/model"
+	"safe-ollama/upstream"
+
+	"github.com/gin-gonic/gin"
+)
+
+func UpstreamHandler(router *gin.Engine) {
+	r := router.Group("/api/upstream", middleware.LoginAuth(), middleware.RoleAuth([]string{model.ADMIN_ROLE}))
+	r.GET("/backends", listBackends())
+}
+
+// GET /api/upstream/backends returns health, load and circuit breaker state of every backend
+func listBackends() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, upstream.Backends())
+	}
+}
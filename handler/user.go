@@ -20,15 +20,50 @@ func UserHandler(router *gin.Engine, db *gorm.DB) {
 }
 
 type UserBean struct {
-	Id       uint   `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Id                uint   `json:"id"`
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	MaxConcurrent     *int   `json:"maxConcurrent"`
+	RequestsPerMinute *int   `json:"requestsPerMinute"`
+	TokensPerMinute   *int   `json:"tokensPerMinute"`
+	TokensPerHour     *int   `json:"tokensPerHour"`
+	// model name patterns such as "llama3*", an empty list allows every model
+	AllowedModels *[]string `json:"allowedModels"`
+	AuditEnabled  *bool     `json:"auditEnabled"`
 }
 
 type UserResult struct {
-	Id       uint   `json:"id"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
+	Id                uint     `json:"id"`
+	Username          string   `json:"username"`
+	Role              string   `json:"role"`
+	MaxConcurrent     int      `json:"maxConcurrent"`
+	RequestsPerMinute int      `json:"requestsPerMinute"`
+	TokensPerMinute   int      `json:"tokensPerMinute"`
+	TokensPerHour     int      `json:"tokensPerHour"`
+	AllowedModels     []string `json:"allowedModels" gorm:"serializer:json"`
+	AuditEnabled      bool     `json:"auditEnabled"`
+}
+
+// applyLimits copies the limits present in the request onto the user.
+func (b *UserBean) applyLimits(user *model.User) {
+	if b.MaxConcurrent != nil {
+		user.MaxConcurrent = *b.MaxConcurrent
+	}
+	if b.RequestsPerMinute != nil {
+		user.RequestsPerMinute = *b.RequestsPerMinute
+	}
+	if b.TokensPerMinute != nil {
+		user.TokensPerMinute = *b.TokensPerMinute
+	}
+	if b.TokensPerHour != nil {
+		user.TokensPerHour = *b.TokensPerHour
+	}
+	if b.AllowedModels != nil {
+		user.AllowedModels = *b.AllowedModels
+	}
+	if b.AuditEnabled != nil {
+		user.AuditEnabled = *b.AuditEnabled
+	}
 }
 
 func getUserInfo(db *gorm.DB) gin.HandlerFunc {
@@ -59,6 +94,7 @@ func createUser(db *gorm.DB) gin.HandlerFunc {
 			Salt:     salt,
 			Role:     model.USER_ROLE,
 		}
+		userBean.applyLimits(&user)
 
 		if err := db.Create(&user).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -88,6 +124,7 @@ func updateUser(db *gorm.DB) gin.HandlerFunc {
 			user.Password = hashedPassword
 			user.Salt = salt
 		}
+		userBean.applyLimits(&user)
 		if err := db.Save(&user).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -2,14 +2,20 @@ package main
 
 import (
 	"embed"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/samber/slog-gin"
 	"io/fs"
 	"net/http"
 	"safe-ollama/config"
 	"safe-ollama/handler"
+	"safe-ollama/middleware"
 	"safe-ollama/model"
+	"safe-ollama/moderation"
+	"safe-ollama/redact"
+	"safe-ollama/upstream"
 	"safe-ollama/utils"
+	"strings"
 )
 
 //go:embed dist/*
@@ -27,14 +33,32 @@ func main() {
 	r.Use(ServerStatic("dist", dist))
 
 	db := model.InitDB()
+	upstream.Init()
+	moderation.Init()
+	redact.Init()
+	middleware.StartAuditRetention(db)
 
 	handler.UserHandler(r, db)
 	handler.AuthHandler(r, db)
 	handler.OllamaHandler(r, db)
 	handler.OllamaTokenHandler(r, db)
 	handler.OllamaTokenUsageHandler(r, db)
+	handler.TokenQuotaHandler(r, db)
+	handler.RequestPolicyHandler(r, db)
+	handler.ModerationHandler(r, db)
+	handler.CacheHandler(r)
+	handler.AuditHandler(r, db)
+	handler.InflightHandler(r)
+	handler.UpstreamHandler(r)
+	handler.MetricsHandler(r)
 
 	r.NoRoute(func(c *gin.Context) {
+		// Ollama endpoints missing from proxy.routes are denied rather than answered with the web UI
+		if path := c.Request.URL.Path; strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/v1/") {
+			middleware.AbortWithError(c, http.StatusNotFound, "route_not_found",
+				fmt.Sprintf("%s %s is not exposed by this proxy", c.Request.Method, path))
+			return
+		}
 		fsys, err := fs.Sub(dist, "dist")
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A minimal registry rendering the Prometheus text format, enough for counters and gauges with labels.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(kind, name, help string, labels []string) *vec {
+	v := &vec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	register(v)
+	return v
+}
+
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec) add(delta float64, values []string) {
+	key := v.key(values)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *vec) set(value float64, values []string) {
+	key := v.key(values)
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", v.name, formatLabels(v.labels, key), v.values[key])
+	}
+	v.mu.Unlock()
+}
+
+func formatLabels(labels []string, key string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=%q", label, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter only goes up.
+type Counter struct {
+	v *vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{v: newVec("counter", name, help, labels)}
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.v.add(1, values)
+}
+
+func (c *Counter) Add(delta float64, values ...string) {
+	c.v.add(delta, values)
+}
+
+// Gauge holds a value that can go up and down.
+type Gauge struct {
+	v *vec
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{v: newVec("gauge", name, help, labels)}
+}
+
+func (g *Gauge) Set(value float64, values ...string) {
+	g.v.set(value, values)
+}
+
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.v.add(delta, values)
+}
+
+// gaugeFunc reads its value when scraped.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", g.name, g.help, g.name, g.name, g.fn())
+}
+
+// Handler serves every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registryMu.Lock()
+		metrics := append([]metric(nil), registry...)
+		registryMu.Unlock()
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
@@ -0,0 +1,347 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens"`
+	System        json.RawMessage    `json:"system"`
+	Messages      []anthropicMessage `json:"messages"`
+	Tools         []anthropicTool    `json:"tools"`
+	Stream        bool               `json:"stream"`
+	Temperature   *float64           `json:"temperature"`
+	TopP          *float64           `json:"top_p"`
+	TopK          *int               `json:"top_k"`
+	StopSequences []string           `json:"stop_sequences"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Source *struct {
+		Type string `json:"type"`
+		Data string `json:"data"`
+	} `json:"source"`
+	// tool_use
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+	// tool_result
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// parseBlocks reads message content, which is either a string or a list of content blocks.
+func parseBlocks(raw json.RawMessage) ([]anthropicBlock, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []anthropicBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, errors.New("content must be a string or a list of content blocks")
+	}
+	return blocks, nil
+}
+
+// appendBlock adds a text or image block to an Ollama message.
+func appendBlock(msg *ollamaMessage, block anthropicBlock) error {
+	switch block.Type {
+	case "text":
+		if msg.Content != "" {
+			msg.Content += "\n"
+		}
+		msg.Content += block.Text
+	case "image":
+		if block.Source == nil || block.Source.Type != "base64" {
+			return errors.New("only base64 image sources are supported")
+		}
+		msg.Images = append(msg.Images, block.Source.Data)
+	default:
+		return fmt.Errorf("unsupported content block type \"%s\"", block.Type)
+	}
+	return nil
+}
+
+// anthropicToOllama translates a Messages API request into an Ollama /api/chat request.
+func anthropicToOllama(body []byte) (*anthropicRequest, []byte, error) {
+	var req anthropicRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nil, errors.New("request body is not a valid Messages API request")
+	}
+	if req.Model == "" {
+		return nil, nil, errors.New("model: field required")
+	}
+	if len(req.Messages) == 0 {
+		return nil, nil, errors.New("messages: at least one message is required")
+	}
+
+	var messages []ollamaMessage
+	system, err := parseBlocks(req.System)
+	if err != nil {
+		return nil, nil, fmt.Errorf("system: %w", err)
+	}
+	if len(system) > 0 {
+		msg := ollamaMessage{Role: "system"}
+		for _, block := range system {
+			if block.Type != "text" {
+				return nil, nil, errors.New("system: only text blocks are supported")
+			}
+			_ = appendBlock(&msg, block)
+		}
+		messages = append(messages, msg)
+	}
+
+	// tool results only carry the id of the call, Ollama wants the name of the tool
+	toolNames := map[string]string{}
+	for i, m := range req.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return nil, nil, fmt.Errorf("messages.%d.role: must be \"user\" or \"assistant\"", i)
+		}
+		blocks, err := parseBlocks(m.Content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("messages.%d.content: %w", i, err)
+		}
+		msg := ollamaMessage{Role: m.Role}
+		for _, block := range blocks {
+			switch block.Type {
+			case "tool_use":
+				msg.ToolCalls = append(msg.ToolCalls, newToolCall(block.Name, block.Input))
+				toolNames[block.ID] = block.Name
+			case "tool_result":
+				result := ollamaMessage{Role: "tool", ToolName: toolNames[block.ToolUseID]}
+				parts, err := parseBlocks(block.Content)
+				if err != nil {
+					return nil, nil, fmt.Errorf("messages.%d.content: tool_result %w", i, err)
+				}
+				for _, part := range parts {
+					if err := appendBlock(&result, part); err != nil {
+						return nil, nil, fmt.Errorf("messages.%d.content: %w", i, err)
+					}
+				}
+				messages = append(messages, result)
+			case "thinking", "redacted_thinking":
+				// earlier reasoning is not replayed to Ollama
+			default:
+				if err := appendBlock(&msg, block); err != nil {
+					return nil, nil, fmt.Errorf("messages.%d.content: %w", i, err)
+				}
+			}
+		}
+		if msg.Content != "" || len(msg.Images) > 0 || len(msg.ToolCalls) > 0 {
+			messages = append(messages, msg)
+		}
+	}
+
+	chat := gin.H{
+		"model":    req.Model,
+		"messages": messages,
+		"stream":   req.Stream,
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]gin.H, 0, len(req.Tools))
+		for _, tool := range req.Tools {
+			tools = append(tools, gin.H{"type": "function", "function": gin.H{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"parameters":  tool.InputSchema,
+			}})
+		}
+		chat["tools"] = tools
+	}
+	options := gin.H{}
+	if req.MaxTokens > 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		options["top_p"] = *req.TopP
+	}
+	if req.TopK != nil {
+		options["top_k"] = *req.TopK
+	}
+	if len(req.StopSequences) > 0 {
+		options["stop"] = req.StopSequences
+	}
+	if len(options) > 0 {
+		chat["options"] = options
+	}
+	translated, err := json.Marshal(chat)
+	return &req, translated, err
+}
+
+func anthropicStopReason(resp ollamaChatResponse, toolUse bool) string {
+	switch {
+	case toolUse:
+		return "tool_use"
+	case resp.DoneReason == "length":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicTranslator answers with a Messages API message, or message_start, content_block_* and
+// message_delta events when streaming.
+type anthropicTranslator struct {
+	id        string
+	started   bool
+	index     int
+	openBlock string
+	toolUse   bool
+}
+
+func (t *anthropicTranslator) event(w *chatWriter, name string, data gin.H) error {
+	data["type"] = name
+	return w.event(name, data)
+}
+
+func (t *anthropicTranslator) startBlock(w *chatWriter, kind string, block gin.H) error {
+	if err := t.stopBlock(w); err != nil {
+		return err
+	}
+	t.openBlock = kind
+	return t.event(w, "content_block_start", gin.H{"index": t.index, "content_block": block})
+}
+
+func (t *anthropicTranslator) stopBlock(w *chatWriter) error {
+	if t.openBlock == "" {
+		return nil
+	}
+	t.openBlock = ""
+	err := t.event(w, "content_block_stop", gin.H{"index": t.index})
+	t.index++
+	return err
+}
+
+func (t *anthropicTranslator) delta(w *chatWriter, kind string, block gin.H, delta gin.H) error {
+	if t.openBlock != kind {
+		if err := t.startBlock(w, kind, block); err != nil {
+			return err
+		}
+	}
+	return t.event(w, "content_block_delta", gin.H{"index": t.index, "delta": delta})
+}
+
+func (t *anthropicTranslator) frame(w *chatWriter, resp ollamaChatResponse) error {
+	if !t.started {
+		t.started = true
+		err := t.event(w, "message_start", gin.H{"message": gin.H{
+			"id":            t.id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         resp.Model,
+			"content":       []any{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			// Ollama reports the prompt size with the last frame only
+			"usage": gin.H{"input_tokens": 0, "output_tokens": 0},
+		}})
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.Message.Thinking != "" {
+		if err := t.delta(w, "thinking", gin.H{"type": "thinking", "thinking": ""},
+			gin.H{"type": "thinking_delta", "thinking": resp.Message.Thinking}); err != nil {
+			return err
+		}
+	}
+	if resp.Message.Content != "" {
+		if err := t.delta(w, "text", gin.H{"type": "text", "text": ""},
+			gin.H{"type": "text_delta", "text": resp.Message.Content}); err != nil {
+			return err
+		}
+	}
+	// Ollama sends tool calls whole
+	for _, call := range resp.Message.ToolCalls {
+		t.toolUse = true
+		if err := t.startBlock(w, "tool_use", gin.H{"type": "tool_use", "id": randomID("toolu_"),
+			"name": call.Function.Name, "input": gin.H{}}); err != nil {
+			return err
+		}
+		if err := t.event(w, "content_block_delta", gin.H{"index": t.index,
+			"delta": gin.H{"type": "input_json_delta", "partial_json": string(call.arguments())}}); err != nil {
+			return err
+		}
+	}
+
+	if !resp.Done {
+		return nil
+	}
+	if err := t.stopBlock(w); err != nil {
+		return err
+	}
+	if err := t.event(w, "message_delta", gin.H{
+		"delta": gin.H{"stop_reason": anthropicStopReason(resp, t.toolUse), "stop_sequence": nil},
+		"usage": gin.H{"input_tokens": resp.PromptEvalCount, "output_tokens": resp.EvalCount},
+	}); err != nil {
+		return err
+	}
+	return t.event(w, "message_stop", gin.H{})
+}
+
+func (t *anthropicTranslator) message(resp ollamaChatResponse) any {
+	content := []gin.H{}
+	if resp.Message.Thinking != "" {
+		content = append(content, gin.H{"type": "thinking", "thinking": resp.Message.Thinking, "signature": ""})
+	}
+	if resp.Message.Content != "" {
+		content = append(content, gin.H{"type": "text", "text": resp.Message.Content})
+	}
+	for _, call := range resp.Message.ToolCalls {
+		content = append(content, gin.H{"type": "tool_use", "id": randomID("toolu_"),
+			"name": call.Function.Name, "input": call.arguments()})
+	}
+	return gin.H{
+		"id":            t.id,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         resp.Model,
+		"content":       content,
+		"stop_reason":   anthropicStopReason(resp, len(resp.Message.ToolCalls) > 0),
+		"stop_sequence": nil,
+		"usage":         gin.H{"input_tokens": resp.PromptEvalCount, "output_tokens": resp.EvalCount},
+	}
+}
+
+// AnthropicMessages serves the Anthropic Messages API on top of Ollama /api/chat.
+func AnthropicMessages() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := RequestBody(c)
+		if err != nil {
+			AbortWithError(c, http.StatusBadRequest, "invalid_request", "failed to read request body")
+			return
+		}
+		req, translated, err := anthropicToOllama(body)
+		if err != nil {
+			AbortWithError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		translateChat(c, translated, req.Stream, &anthropicTranslator{id: randomID("msg_")})
+	}
+}
@@ -0,0 +1,184 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"safe-ollama/config"
+	"safe-ollama/model"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// auditWriter reassembles the generated text of a response while it is written to the client,
+// keeping at most AuditMaxResponseSize bytes.
+type auditWriter struct {
+	gin.ResponseWriter
+	scanner   *frameScanner
+	raw       []byte
+	text      strings.Builder
+	truncated bool
+	embedding bool // vectors are not worth keeping, only errors are recorded
+}
+
+// non-streamed bodies wrap the text in JSON, so a bit more than the text limit is buffered
+func auditRawLimit() int {
+	return config.AuditMaxResponseSize*2 + 4096
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.scanner == nil && w.raw == nil {
+		if kind := streamKind(w.Header().Get("Content-Type")); kind != streamNone {
+			w.scanner = &frameScanner{kind: kind, onFrame: w.onFrame}
+		} else {
+			w.raw = make([]byte, 0, 512)
+		}
+	}
+	if w.scanner != nil {
+		w.scanner.Write(b)
+	} else if !w.embedding || w.Status() != http.StatusOK {
+		kept := b
+		if remaining := auditRawLimit() - len(w.raw); len(kept) > remaining {
+			kept = kept[:max(remaining, 0)]
+			w.truncated = true
+		}
+		w.raw = append(w.raw, kept...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *auditWriter) onFrame(payload []byte) {
+	if w.truncated {
+		return
+	}
+	if data := decodeObject(payload); data != nil {
+		w.appendText(frameText(data))
+	}
+}
+
+func (w *auditWriter) appendText(text string) {
+	if remaining := config.AuditMaxResponseSize - w.text.Len(); len(text) > remaining {
+		text = truncateUTF8(text, remaining)
+		w.truncated = true
+	}
+	w.text.WriteString(text)
+}
+
+// response returns the generated text, or the raw body for errors and responses without text.
+func (w *auditWriter) response() string {
+	if w.scanner != nil {
+		w.scanner.Close()
+		return w.text.String()
+	}
+	if data := decodeObject(w.raw); data != nil && w.Status() == http.StatusOK {
+		w.appendText(frameText(data))
+		return w.text.String()
+	}
+	w.appendText(string(w.raw))
+	return w.text.String()
+}
+
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// auditPrompt extracts the conversation of the forwarded request.
+func auditPrompt(c *gin.Context) string {
+	data := decodeRequestJSON(c)
+	if data == nil {
+		return ""
+	}
+	prompt := map[string]any{}
+	for _, key := range []string{"system", "prompt", "suffix", "messages", "input", "instructions", "tools"} {
+		if v, ok := data[key]; ok {
+			prompt[key] = v
+		}
+	}
+	encoded, err := json.Marshal(prompt)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// Audit stores the prompt and the reassembled response of requests made by users or tokens with auditing
+// enabled. It must run after OllamaAuth.
+func Audit(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(model.User)
+		token := c.MustGet("ollamaToken").(model.OllamaToken)
+		if !config.AuditAll && !user.AuditEnabled && !token.AuditEnabled {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		writer := &auditWriter{ResponseWriter: c.Writer, embedding: isEmbeddingRoute(c.FullPath())}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		// the body has been rewritten by policies and redaction by now, so this is what Ollama received
+		prompt := auditPrompt(c)
+		response := writer.response()
+		truncated := writer.truncated
+		if len(prompt) > config.AuditMaxPromptSize {
+			prompt = truncateUTF8(prompt, config.AuditMaxPromptSize)
+			truncated = true
+		}
+		record := model.AuditRecord{
+			UserId:      user.ID,
+			TokenId:     token.ID,
+			Path:        c.Request.URL.Path,
+			OllamaModel: RequestModel(c),
+			Prompt:      prompt,
+			Response:    response,
+			Status:      writer.Status(),
+			Truncated:   truncated,
+			DurationMs:  time.Since(start).Milliseconds(),
+		}
+		go func() {
+			if err := db.Create(&record).Error; err != nil {
+				slog.Error("[Audit] fail to create audit record", "error", err)
+			}
+		}()
+	}
+}
+
+// StartAuditRetention deletes audit records older than the retention window once an hour.
+func StartAuditRetention(db *gorm.DB) {
+	if config.AuditRetentionDays <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			cutoff := time.Now().AddDate(0, 0, -config.AuditRetentionDays)
+			result := db.Where("time < ?", cutoff).Delete(&model.AuditRecord{})
+			if result.Error != nil {
+				slog.Error("[Audit] fail to purge audit records", "error", result.Error)
+			} else if result.RowsAffected > 0 {
+				slog.Info("[Audit] purged expired audit records", "count", result.RowsAffected)
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
 	"safe-ollama/config"
@@ -69,35 +70,69 @@ func RoleAuth(role []string) gin.HandlerFunc {
 	}
 }
 
+// OllamaAuth authenticates API tokens and rejects requests once a token quota of the user is used up.
 func OllamaAuth(db *gorm.DB) gin.HandlerFunc {
+	return ollamaAuth(db, true)
+}
+
+// OllamaTokenAuth authenticates API tokens without enforcing quotas.
+func OllamaTokenAuth(db *gorm.DB) gin.HandlerFunc {
+	return ollamaAuth(db, false)
+}
+
+func ollamaAuth(db *gorm.DB, enforceQuota bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.Request.Header.Get("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is missing"})
-			c.Abort()
+		// Anthropic clients send the bare key in x-api-key
+		token := c.Request.Header.Get("X-Api-Key")
+		if authHeader == "" && token == "" {
+			AbortWithError(c, http.StatusUnauthorized, "invalid_api_key", "Authorization header is missing")
 			return
 		}
 
-		// Extract token from "Bearer token"
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format"})
-			c.Abort()
-			return
+		if authHeader != "" {
+			// Extract token from "Bearer token"
+			parts := strings.SplitN(authHeader, " ", 2)
+			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+				AbortWithError(c, http.StatusUnauthorized, "invalid_api_key", "Invalid authorization format")
+				return
+			}
+			token = parts[1]
 		}
 
-		token := parts[1]
-
 		// Verify token in the database
 		var ollamaToken model.OllamaToken
 		if err := db.Where("token = ?", token).First(&ollamaToken).Error; err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			AbortWithError(c, http.StatusUnauthorized, "invalid_api_key", "Invalid token")
+			return
+		}
+
+		var user model.User
+		if err := db.First(&user, ollamaToken.UserId).Error; err != nil {
+			AbortWithError(c, http.StatusUnauthorized, "invalid_api_key", "Invalid token")
 			return
 		}
 
 		c.Set("ollamaToken", ollamaToken)
+		c.Set("user", user)
+
+		if enforceQuota && !checkQuota(c, db, user) {
+			return
+		}
+
+		c.Next()
+	}
+}
 
+// RequireScope rejects API tokens that do not grant the scope. It must run after OllamaAuth.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.MustGet("ollamaToken").(model.OllamaToken)
+		if !token.HasScope(scope) {
+			AbortWithError(c, http.StatusForbidden, "insufficient_scope",
+				fmt.Sprintf("token lacks the \"%s\" scope required by this endpoint", scope))
+			return
+		}
 		c.Next()
 	}
 }
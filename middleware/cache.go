@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"safe-ollama/config"
+	"safe-ollama/model"
+	"safe-ollama/upstream"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const cacheHitKey = "cacheHit"
+
+type cacheEntry struct {
+	key         string
+	model       string
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// responseCache is an LRU cache bounded by the total size of the cached bodies.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int
+	hits    int64
+	misses  int64
+}
+
+var cache = &responseCache{entries: make(map[string]*list.Element), lru: list.New()}
+
+func (rc *responseCache) get(key string) *cacheEntry {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	el, ok := rc.entries[key]
+	if !ok {
+		rc.misses++
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.remove(el)
+		rc.misses++
+		return nil
+	}
+	rc.lru.MoveToFront(el)
+	rc.hits++
+	return entry
+}
+
+func (rc *responseCache) put(entry *cacheEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[entry.key]; ok {
+		rc.remove(el)
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	rc.size += len(entry.body)
+	for rc.size > config.CacheMaxSize && rc.lru.Len() > 0 {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// remove drops an entry. Caller holds rc.mu.
+func (rc *responseCache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	rc.lru.Remove(el)
+	delete(rc.entries, entry.key)
+	rc.size -= len(entry.body)
+}
+
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int   `json:"size"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func GetCacheStats() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return CacheStats{Entries: cache.lru.Len(), Size: cache.size, Hits: cache.hits, Misses: cache.misses}
+}
+
+// PurgeCache removes the cached responses of a model, or every response if model is empty.
+// It returns the number of removed entries.
+func PurgeCache(ollamaModel string) int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	removed := 0
+	for el := cache.lru.Front(); el != nil; {
+		next := el.Next()
+		if ollamaModel == "" || el.Value.(*cacheEntry).model == upstream.NormalizeModel(ollamaModel) {
+			cache.remove(el)
+			removed++
+		}
+		el = next
+	}
+	return removed
+}
+
+func isZero(v any) bool {
+	n, ok := v.(json.Number)
+	if !ok {
+		return false
+	}
+	f, err := n.Float64()
+	return err == nil && f == 0
+}
+
+// deterministic reports whether the request asks for reproducible sampling: temperature 0 or a seed.
+func deterministic(data map[string]any) bool {
+	for _, params := range []any{data, data["options"]} {
+		p, ok := params.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, ok := p["seed"]; ok {
+			return true
+		}
+		if t, ok := p["temperature"]; ok && isZero(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEmbeddingRoute(path string) bool {
+	return path == "/api/embed" || path == "/api/embeddings" || path == "/v1/embeddings"
+}
+
+type cacheWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.body.Len()+len(b) > config.CacheMaxEntrySize {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// ResponseCache serves embeddings and deterministic completions from an in-memory cache, keyed by the
+// route and the normalized request body. Hits are marked for OllamaTokenCount so that they are accounted
+// separately. It must run after OllamaAuth.
+func ResponseCache() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.CacheEnabled || c.Request.Method != http.MethodPost {
+			c.Next()
+			return
+		}
+		data := decodeRequestJSON(c)
+		if data == nil || (!isEmbeddingRoute(c.FullPath()) && !deterministic(data)) {
+			c.Next()
+			return
+		}
+
+		// keep_alive does not change the answer
+		delete(data, "keep_alive")
+		ollamaModel, _ := data["model"].(string)
+		ollamaModel = upstream.NormalizeModel(ollamaModel)
+		data["model"] = ollamaModel
+		normalized, err := json.Marshal(data)
+		if err != nil {
+			c.Next()
+			return
+		}
+		h := sha256.New()
+		h.Write([]byte(c.FullPath() + "\n"))
+		if !config.CacheShared {
+			h.Write([]byte(strconv.FormatUint(uint64(c.MustGet("user").(model.User).ID), 10) + "\n"))
+		}
+		h.Write(normalized)
+		key := hex.EncodeToString(h.Sum(nil))
+
+		if entry := cache.get(key); entry != nil {
+			c.Set(cacheHitKey, true)
+			c.Header("X-Cache", "HIT")
+			c.Data(http.StatusOK, entry.contentType, entry.body)
+			c.Abort()
+			return
+		}
+
+		c.Header("X-Cache", "MISS")
+		writer := &cacheWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		// a usage status marks a response cut short by a disconnect, a timeout or a read error
+		if writer.Status() != http.StatusOK || writer.overflow || writer.body.Len() == 0 || c.IsAborted() ||
+			c.GetString(usageStatusKey) != "" {
+			return
+		}
+		contentType := writer.Header().Get("Content-Type")
+		if !strings.Contains(contentType, "json") && !strings.Contains(contentType, "event-stream") {
+			return
+		}
+		cache.put(&cacheEntry{
+			key:         key,
+			model:       ollamaModel,
+			contentType: contentType,
+			body:        writer.body.Bytes(),
+			expires:     time.Now().Add(time.Duration(config.CacheTTL) * time.Second),
+		})
+		slog.Debug("[Cache] response cached", "model", ollamaModel, "size", writer.body.Len())
+	}
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IsOpenAIRoute reports whether the request targets the OpenAI compatible API.
+func IsOpenAIRoute(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, "/v1/") && !IsAnthropicRoute(c)
+}
+
+// IsAnthropicRoute reports whether the request targets the Anthropic compatible Messages API.
+func IsAnthropicRoute(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, "/v1/messages")
+}
+
+// AbortWithError aborts the request with an error body in the dialect of the requested API.
+func AbortWithError(c *gin.Context, status int, code string, message string) {
+	if IsAnthropicRoute(c) {
+		c.AbortWithStatusJSON(status, gin.H{"type": "error", "error": gin.H{
+			"type":    anthropicErrorType(status),
+			"message": message,
+		}})
+		return
+	}
+	if IsOpenAIRoute(c) {
+		c.AbortWithStatusJSON(status, gin.H{"error": gin.H{
+			"message": message,
+			"type":    openAIErrorType(status, code),
+			"param":   nil,
+			"code":    code,
+		}})
+		return
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": message})
+}
+
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == http.StatusServiceUnavailable:
+		return "overloaded_error"
+	case status >= 500:
+		return "api_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+func openAIErrorType(status int, code string) string {
+	switch {
+	case code == "insufficient_quota":
+		return code
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// AbortWithUpstreamError relays an error response of Ollama. JSON bodies are passed through as they are,
+// except on the OpenAI and Anthropic compatible APIs where Ollama's {"error": "..."} is translated to their shape.
+func AbortWithUpstreamError(c *gin.Context, status int, body []byte) {
+	body = bytes.TrimSpace(body)
+	var data struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &data) != nil {
+		message := string(body)
+		if message == "" {
+			message = http.StatusText(status)
+		}
+		AbortWithError(c, status, upstreamErrorCode(status), message)
+		return
+	}
+	if IsOpenAIRoute(c) || IsAnthropicRoute(c) {
+		var message string
+		if json.Unmarshal(data.Error, &message) == nil && message != "" {
+			AbortWithError(c, status, upstreamErrorCode(status), message)
+			return
+		}
+	}
+	c.Abort()
+	c.Data(status, "application/json; charset=utf-8", body)
+}
+
+func upstreamErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusNotFound:
+		return "model_not_found"
+	case http.StatusTooManyRequests:
+		return "rate_limit_exceeded"
+	default:
+		return "upstream_error"
+	}
+}
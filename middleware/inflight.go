@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"safe-ollama/metrics"
+	"safe-ollama/model"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sloggin "github.com/samber/slog-gin"
+)
+
+// InflightRequest describes a proxied request that is still running.
+type InflightRequest struct {
+	ID      string    `json:"id"`
+	UserId  uint      `json:"userId"`
+	TokenId uint      `json:"tokenId"`
+	Path    string    `json:"path"`
+	Model   string    `json:"model"`
+	Backend string    `json:"backend"`
+	Start   time.Time `json:"start"`
+}
+
+type inflightEntry struct {
+	InflightRequest
+	cancel context.CancelCauseFunc
+}
+
+const inflightKey = "inflightRequest"
+
+var errCancelledByAdmin = errors.New("cancelled by administrator")
+
+var inflight = struct {
+	sync.Mutex
+	requests map[string]*inflightEntry
+}{requests: make(map[string]*inflightEntry)}
+
+var cancelledRequests = metrics.NewCounter("safe_ollama_requests_cancelled_total",
+	"Proxied requests cancelled before completion.", "path", "reason")
+
+func init() {
+	metrics.NewGaugeFunc("safe_ollama_inflight_requests", "Proxied requests currently running.", func() float64 {
+		inflight.Lock()
+		defer inflight.Unlock()
+		return float64(len(inflight.requests))
+	})
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Inflight registers the request so that admins can list and cancel it. The request context is replaced by
+// one that is cancelled when the client disconnects or an admin cancels it, upstream calls must use it.
+// It must run after OllamaAuth.
+func Inflight() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.MustGet("ollamaToken").(model.OllamaToken)
+		ctx, cancel := context.WithCancelCause(c.Request.Context())
+		entry := &inflightEntry{
+			InflightRequest: InflightRequest{
+				ID:      sloggin.GetRequestID(c),
+				UserId:  token.UserId,
+				TokenId: token.ID,
+				Path:    c.FullPath(),
+				Model:   RequestModel(c),
+				Start:   time.Now(),
+			},
+			cancel: cancel,
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(inflightKey, entry)
+
+		inflight.Lock()
+		// the id logged for the request is reused, unless the client sent one that is already running
+		if _, taken := inflight.requests[entry.ID]; taken || entry.ID == "" {
+			entry.ID = newRequestId()
+			c.Header(sloggin.RequestIDHeaderKey, entry.ID)
+		}
+		inflight.requests[entry.ID] = entry
+		inflight.Unlock()
+		defer func() {
+			inflight.Lock()
+			delete(inflight.requests, entry.ID)
+			inflight.Unlock()
+			cancel(nil)
+		}()
+
+		c.Next()
+
+		if ctx.Err() != nil {
+			reason := "client"
+			if errors.Is(context.Cause(ctx), errCancelledByAdmin) {
+				reason = "admin"
+			}
+			cancelledRequests.Inc(entry.Path, reason)
+			slog.Info("[Inflight] request cancelled", "id", entry.ID, "reason", reason, "path", entry.Path,
+				"userId", entry.UserId, "model", entry.Model, "duration", time.Since(entry.Start))
+		}
+	}
+}
+
+// SetInflightBackend records the backend serving the request.
+func SetInflightBackend(c *gin.Context, backend string) {
+	if obj, ok := c.Get(inflightKey); ok {
+		entry := obj.(*inflightEntry)
+		inflight.Lock()
+		entry.Backend = backend
+		inflight.Unlock()
+	}
+}
+
+// CancelledByAdmin reports whether the request was cancelled through CancelInflight.
+func CancelledByAdmin(c *gin.Context) bool {
+	return errors.Is(context.Cause(c.Request.Context()), errCancelledByAdmin)
+}
+
+// ListInflight returns the running requests, oldest first.
+func ListInflight() []InflightRequest {
+	inflight.Lock()
+	requests := make([]InflightRequest, 0, len(inflight.requests))
+	for _, entry := range inflight.requests {
+		requests = append(requests, entry.InflightRequest)
+	}
+	inflight.Unlock()
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Start.Before(requests[j].Start)
+	})
+	return requests
+}
+
+// CancelInflight cancels a running request, it returns false if there is no such request.
+func CancelInflight(id string) bool {
+	inflight.Lock()
+	entry, ok := inflight.requests[id]
+	inflight.Unlock()
+	if ok {
+		entry.cancel(errCancelledByAdmin)
+	}
+	return ok
+}
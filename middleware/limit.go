@@ -0,0 +1,336 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"safe-ollama/config"
+	"safe-ollama/model"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errQueueFull    = errors.New("request queue is full")
+	errQueueShare   = errors.New("request queue share exceeded")
+	errQueueTimeout = errors.New("timed out waiting in request queue")
+)
+
+type limitKey struct {
+	scope string
+	id    uint
+	limit int
+}
+
+func (k limitKey) String() string {
+	return fmt.Sprintf("%s:%d", k.scope, k.id)
+}
+
+type waiter struct {
+	keys    []limitKey
+	userId  uint
+	ready   chan struct{}
+	granted bool
+	// blocked is the last limit that kept the waiter in the queue
+	blocked *limitKey
+}
+
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	global   int
+	inflight map[string]int
+
+	// waiters in arrival order, dispatched by stride scheduling across users so that
+	// every user gets a share of freed slots proportional to its weight
+	waiters []*waiter
+	queued  map[uint]int
+	pass    map[uint]float64
+	weight  map[uint]int
+}
+
+var limiter = &concurrencyLimiter{
+	inflight: make(map[string]int),
+	queued:   make(map[uint]int),
+	pass:     make(map[uint]float64),
+	weight:   make(map[uint]int),
+}
+
+// blockedBy returns the limit that prevents the keys from being acquired, nil if they can be. Caller holds l.mu.
+func (l *concurrencyLimiter) blockedBy(keys []limitKey) *limitKey {
+	if config.GlobalConcurrent > 0 && l.global >= config.GlobalConcurrent {
+		return &limitKey{scope: "global", limit: config.GlobalConcurrent}
+	}
+	for i, k := range keys {
+		if l.inflight[k.String()] >= k.limit {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// take acquires a slot for every key. Caller holds l.mu.
+func (l *concurrencyLimiter) take(keys []limitKey) {
+	l.global++
+	for _, k := range keys {
+		l.inflight[k.String()]++
+	}
+}
+
+func (l *concurrencyLimiter) release(keys []limitKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global--
+	for _, k := range keys {
+		if l.inflight[k.String()] <= 1 {
+			delete(l.inflight, k.String())
+		} else {
+			l.inflight[k.String()]--
+		}
+	}
+	l.dispatch()
+}
+
+// dispatch hands freed slots to queued waiters, the user with the lowest pass goes first. Caller holds l.mu.
+func (l *concurrencyLimiter) dispatch() {
+	for {
+		var next *waiter
+		for _, w := range l.waiters {
+			if w.blocked = l.blockedBy(w.keys); w.blocked != nil {
+				continue
+			}
+			if next == nil || l.pass[w.userId] < l.pass[next.userId] {
+				next = w
+			}
+		}
+		if next == nil {
+			return
+		}
+		l.take(next.keys)
+		next.granted = true
+		l.pass[next.userId] += 1 / float64(l.weight[next.userId])
+		l.dequeue(next)
+		close(next.ready)
+	}
+}
+
+// enqueue adds a waiter, evicting the newest waiter of the user most over its fair share when the queue is full.
+// Caller holds l.mu.
+func (l *concurrencyLimiter) enqueue(w *waiter, weight int) error {
+	size := config.QueueSize
+	if _, ok := l.weight[w.userId]; !ok {
+		l.weight[w.userId] = weight
+		// a user joining the queue starts at the current minimum pass so it can not claim past idle time
+		minPass, found := 0.0, false
+		for id, p := range l.pass {
+			if l.queued[id] > 0 && (!found || p < minPass) {
+				minPass, found = p, true
+			}
+		}
+		if l.pass[w.userId] < minPass {
+			l.pass[w.userId] = minPass
+		}
+	}
+
+	if len(l.waiters) >= size {
+		totalWeight := 0
+		for id := range l.weight {
+			totalWeight += l.weight[id]
+		}
+		share := func(id uint) float64 {
+			return float64(size*l.weight[id]) / float64(totalWeight)
+		}
+		if float64(l.queued[w.userId]+1) > share(w.userId) {
+			l.forget(w.userId)
+			if l.queued[w.userId] > 0 {
+				return errQueueShare
+			}
+			return errQueueFull
+		}
+		// find the user most over its share and evict its newest waiter
+		var victim *waiter
+		worst := 0.0
+		for i := len(l.waiters) - 1; i >= 0; i-- {
+			v := l.waiters[i]
+			if over := float64(l.queued[v.userId]) - share(v.userId); over > worst {
+				worst, victim = over, v
+			}
+		}
+		if victim == nil {
+			l.forget(w.userId)
+			return errQueueFull
+		}
+		l.dequeue(victim)
+		close(victim.ready)
+	}
+
+	l.waiters = append(l.waiters, w)
+	l.queued[w.userId]++
+	return nil
+}
+
+// schedulePosition returns the place of w in the order dispatch serves the queue, 1 being next, assuming
+// every waiter can take the freed slots. Caller holds l.mu.
+func (l *concurrencyLimiter) schedulePosition(w *waiter) int {
+	pass := make(map[uint]float64, len(l.pass))
+	for id, p := range l.pass {
+		pass[id] = p
+	}
+	served := make(map[*waiter]bool, len(l.waiters))
+	for position := 1; ; position++ {
+		var next *waiter
+		for _, v := range l.waiters {
+			if !served[v] && (next == nil || pass[v.userId] < pass[next.userId]) {
+				next = v
+			}
+		}
+		if next == nil || next == w {
+			return position
+		}
+		served[next] = true
+		pass[next.userId] += 1 / float64(l.weight[next.userId])
+	}
+}
+
+// dequeue removes a waiter from the queue. Caller holds l.mu.
+func (l *concurrencyLimiter) dequeue(w *waiter) {
+	for i, v := range l.waiters {
+		if v == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			l.queued[w.userId]--
+			l.forget(w.userId)
+			return
+		}
+	}
+}
+
+// forget drops scheduling state of a user that has nothing queued. Caller holds l.mu.
+func (l *concurrencyLimiter) forget(userId uint) {
+	if l.queued[userId] <= 0 {
+		delete(l.queued, userId)
+		delete(l.weight, userId)
+		delete(l.pass, userId)
+	}
+}
+
+// acquire takes a slot for every key, waiting in the queue up to the configured max wait. It returns the
+// position in the scheduling order on entry (0 if not queued) and the limit that was hit on failure.
+func (l *concurrencyLimiter) acquire(ctx context.Context, keys []limitKey, userId uint, weight int) (int, *limitKey, error) {
+	l.mu.Lock()
+	full := l.blockedBy(keys)
+	if full == nil {
+		l.take(keys)
+		l.mu.Unlock()
+		return 0, nil, nil
+	}
+	if config.QueueSize <= 0 {
+		l.mu.Unlock()
+		return 0, full, errQueueFull
+	}
+
+	w := &waiter{keys: keys, userId: userId, ready: make(chan struct{}), blocked: full}
+	if err := l.enqueue(w, weight); err != nil {
+		l.mu.Unlock()
+		return 0, full, err
+	}
+	position := l.schedulePosition(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Duration(config.QueueMaxWait) * time.Second)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	granted, blocked := w.granted, w.blocked
+	if !granted && err != nil {
+		l.dequeue(w)
+	}
+	l.mu.Unlock()
+
+	switch {
+	case granted && ctx.Err() != nil:
+		// granted while the client went away, hand the slot to the next waiter
+		l.release(keys)
+		return position, nil, ctx.Err()
+	case granted:
+		return position, nil, nil
+	case err == nil:
+		// woken without a grant: evicted in favour of a user under its share
+		return position, blocked, errQueueShare
+	default:
+		return position, blocked, err
+	}
+}
+
+// UserConcurrentLimit resolves the effective limit of a user, 0 means unlimited.
+func UserConcurrentLimit(user model.User) int {
+	return resolveLimit(user.MaxConcurrent, config.RoleLimits[user.Role].Concurrent)
+}
+
+func userQueueWeight(user model.User) int {
+	if weight := config.RoleLimits[user.Role].QueueWeight; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+func concurrencyKeys(user model.User, token model.OllamaToken) []limitKey {
+	var keys []limitKey
+	if token.MaxConcurrent > 0 {
+		keys = append(keys, limitKey{scope: "token", id: token.ID, limit: token.MaxConcurrent})
+	}
+	if limit := UserConcurrentLimit(user); limit > 0 {
+		keys = append(keys, limitKey{scope: "user", id: user.ID, limit: limit})
+	}
+	return keys
+}
+
+// ConcurrencyLimit caps the number of in-flight requests per token, per user and globally.
+// Requests over the limit wait in a bounded fair queue. It must run after OllamaAuth.
+func ConcurrencyLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(model.User)
+		token := c.MustGet("ollamaToken").(model.OllamaToken)
+		keys := concurrencyKeys(user, token)
+
+		start := time.Now()
+		position, full, err := limiter.acquire(c.Request.Context(), keys, user.ID, userQueueWeight(user))
+		wait := time.Since(start)
+		if position > 0 {
+			slog.Info("[Limit] request queued", "user", user.ID, "token", token.ID,
+				"position", position, "wait", wait, "error", err)
+			// only known once the wait is over, they tell the client how its request was queued
+			c.Header("X-Queue-Position", strconv.Itoa(position))
+			c.Header("X-Queue-Wait-Ms", strconv.FormatInt(wait.Milliseconds(), 10))
+		}
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				c.Abort()
+				return
+			}
+			msg := err.Error()
+			if full != nil {
+				msg = fmt.Sprintf("too many concurrent requests: %s limit of %d reached, %s", full.scope, full.limit, err)
+				c.Header("X-Concurrency-Limit-Scope", full.scope)
+			}
+			slog.Info("[Limit] request rejected", "user", user.ID, "token", token.ID, "error", err)
+			AbortWithError(c, http.StatusTooManyRequests, "concurrency_limit_exceeded", msg)
+			return
+		}
+		defer limiter.release(keys)
+
+		c.Next()
+	}
+}
@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"safe-ollama/config"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T, global, queueSize int) *concurrencyLimiter {
+	t.Helper()
+	oldGlobal, oldSize, oldWait := config.GlobalConcurrent, config.QueueSize, config.QueueMaxWait
+	config.GlobalConcurrent = global
+	config.QueueSize = queueSize
+	config.QueueMaxWait = 60
+	t.Cleanup(func() {
+		config.GlobalConcurrent, config.QueueSize, config.QueueMaxWait = oldGlobal, oldSize, oldWait
+	})
+	return &concurrencyLimiter{
+		inflight: make(map[string]int),
+		queued:   make(map[uint]int),
+		pass:     make(map[uint]float64),
+		weight:   make(map[uint]int),
+	}
+}
+
+// queueWaiters queues n waiters of a user, the queue must have room for them.
+func (l *concurrencyLimiter) queueWaiters(t *testing.T, userId uint, weight, n int) []*waiter {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var waiters []*waiter
+	for i := 0; i < n; i++ {
+		w := &waiter{userId: userId, ready: make(chan struct{})}
+		if err := l.enqueue(w, weight); err != nil {
+			t.Fatalf("enqueue user %d waiter %d: %v", userId, i, err)
+		}
+		waiters = append(waiters, w)
+	}
+	return waiters
+}
+
+func (l *concurrencyLimiter) waitQueued(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		queued := len(l.waiters)
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("queue never reached %d waiters", n)
+}
+
+func TestLimiterWeightedShareOfFullQueue(t *testing.T) {
+	l := newTestLimiter(t, 1, 4)
+	l.take(nil)
+	l.queueWaiters(t, 1, 3, 3)
+	l.queueWaiters(t, 2, 1, 1)
+
+	tests := []struct {
+		name   string
+		userId uint
+		weight int
+		want   error
+	}{
+		// user 1 holds 3 of 4 places, its share with weight 3 of 4
+		{"heavy user at its share", 1, 3, errQueueShare},
+		{"light user at its share", 2, 1, errQueueShare},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			err := l.enqueue(&waiter{userId: tt.userId, ready: make(chan struct{})}, tt.weight)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("enqueue = %v, want %v", err, tt.want)
+			}
+			if len(l.waiters) != 4 || l.queued[1] != 3 || l.queued[2] != 1 {
+				t.Fatalf("queue changed: %d waiters, queued %v", len(l.waiters), l.queued)
+			}
+		})
+	}
+
+	// a new user whose share is below one place is rejected without evicting anyone
+	l.mu.Lock()
+	err := l.enqueue(&waiter{userId: 3, ready: make(chan struct{})}, 1)
+	_, remembered := l.weight[3]
+	l.mu.Unlock()
+	if !errors.Is(err, errQueueFull) {
+		t.Fatalf("enqueue of a new user = %v, want %v", err, errQueueFull)
+	}
+	if remembered {
+		t.Fatal("rejected user left scheduling state behind")
+	}
+}
+
+func TestLimiterWeightedDispatch(t *testing.T) {
+	l := newTestLimiter(t, 1, 8)
+	l.take(nil)
+	waiters := append(l.queueWaiters(t, 1, 3, 4), l.queueWaiters(t, 2, 1, 4)...)
+
+	var order []uint
+	seen := map[*waiter]bool{}
+	for i := 0; i < 8; i++ {
+		l.release(nil)
+		l.mu.Lock()
+		if l.global != 1 {
+			t.Fatalf("release %d: %d slots taken, want 1", i, l.global)
+		}
+		for _, w := range waiters {
+			if w.granted && !seen[w] {
+				seen[w] = true
+				order = append(order, w.userId)
+			}
+		}
+		l.mu.Unlock()
+	}
+	// weight 3 against 1: three grants for user 1 for each grant of user 2 while both are queued
+	want := []uint{1, 2, 1, 1, 1, 2, 2, 2}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Fatalf("grant order = %v, want %v", order, want)
+	}
+}
+
+func TestLimiterEvictsUserMostOverShare(t *testing.T) {
+	l := newTestLimiter(t, 1, 6)
+	l.take(nil)
+	first := l.queueWaiters(t, 1, 1, 4)
+	second := l.queueWaiters(t, 2, 1, 2)
+
+	// with three users each one's share is 2 places, user 1 is 2 over, user 2 is at its share
+	third := l.queueWaiters(t, 3, 1, 1)
+
+	select {
+	case <-first[3].ready:
+	default:
+		t.Fatal("newest waiter of user 1 was not evicted")
+	}
+	if first[3].granted {
+		t.Fatal("evicted waiter was granted a slot")
+	}
+	for _, w := range append(append(first[:3:3], second...), third...) {
+		select {
+		case <-w.ready:
+			t.Fatalf("waiter of user %d was woken", w.userId)
+		default:
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queued[1] != 3 || l.queued[2] != 2 || l.queued[3] != 1 || len(l.waiters) != 6 {
+		t.Fatalf("queued %v with %d waiters, want 3, 2 and 1", l.queued, len(l.waiters))
+	}
+	if l.waiters[5] != third[0] {
+		t.Fatal("new waiter is not at the end of the queue")
+	}
+}
+
+func TestLimiterEvictedAcquireFails(t *testing.T) {
+	l := newTestLimiter(t, 1, 2)
+	l.take(nil)
+
+	results := make([]chan error, 3)
+	for i, userId := range []uint{1, 1, 2} {
+		results[i] = make(chan error, 1)
+		go func() {
+			_, _, err := l.acquire(context.Background(), nil, userId, 1)
+			results[i] <- err
+		}()
+		if i < 2 {
+			l.waitQueued(t, i+1)
+		}
+	}
+
+	// user 2 takes the place of the newest waiter of user 1
+	select {
+	case err := <-results[1]:
+		if !errors.Is(err, errQueueShare) {
+			t.Fatalf("evicted acquire = %v, want %v", err, errQueueShare)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("evicted acquire never returned")
+	}
+	for _, i := range []int{0, 2} {
+		l.release(nil)
+		if err := <-results[i]; err != nil {
+			t.Fatalf("acquire %d = %v", i, err)
+		}
+	}
+}
+
+func TestLimiterGrantAfterCancelReleasesSlot(t *testing.T) {
+	l := newTestLimiter(t, 1, 4)
+	l.take(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelled := make(chan error, 1)
+	go func() {
+		_, _, err := l.acquire(ctx, nil, 1, 1)
+		cancelled <- err
+	}()
+	l.waitQueued(t, 1)
+	next := make(chan error, 1)
+	go func() {
+		_, _, err := l.acquire(context.Background(), nil, 2, 1)
+		next <- err
+	}()
+	l.waitQueued(t, 2)
+
+	// the slot is freed and granted to the first waiter just as its client goes away,
+	// holding the lock so that the waiter can not leave the queue in between
+	l.mu.Lock()
+	cancel()
+	l.global--
+	l.dispatch()
+	l.mu.Unlock()
+
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled acquire = %v, want %v", err, context.Canceled)
+	}
+	select {
+	case err := <-next:
+		if err != nil {
+			t.Fatalf("next acquire = %v, want the released slot", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slot of the cancelled waiter was not handed to the next one")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global != 1 || len(l.waiters) != 0 || len(l.queued) != 0 {
+		t.Fatalf("%d slots taken, %d waiters, queued %v, want only the next waiter's slot", l.global, len(l.waiters), l.queued)
+	}
+}
+
+func TestLimiterSchedulePosition(t *testing.T) {
+	l := newTestLimiter(t, 1, 8)
+	l.take(nil)
+	waiters := append(l.queueWaiters(t, 1, 3, 4), l.queueWaiters(t, 2, 1, 2)...)
+
+	// stride scheduling serves 1, 2, 1, 1, 1, 2 and not in arrival order
+	want := []int{1, 3, 4, 5, 2, 6}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range waiters {
+		if got := l.schedulePosition(w); got != want[i] {
+			t.Errorf("waiter %d of user %d: position %d, want %d", i, w.userId, got, want[i])
+		}
+	}
+}
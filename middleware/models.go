@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"safe-ollama/model"
+	"safe-ollama/upstream"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// matchModel reports whether a model name matches a glob pattern, "*" and "?" also match "/".
+// A pattern without tag matches the ":latest" tag like Ollama does.
+func matchModel(pattern string, name string) bool {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return false
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		return upstream.NormalizeModel(pattern) == upstream.NormalizeModel(name)
+	}
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(name) || re.MatchString(upstream.NormalizeModel(name))
+}
+
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchModel(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelAllowed reports whether the authenticated user and token may use the model.
+func ModelAllowed(c *gin.Context, name string) bool {
+	if user, ok := c.Get("user"); ok && !matchAny(user.(model.User).AllowedModels, name) {
+		return false
+	}
+	if token, ok := c.Get("ollamaToken"); ok && !matchAny(token.(model.OllamaToken).AllowedModels, name) {
+		return false
+	}
+	return true
+}
+
+// ModelAccess rejects requests for models outside the allowlists of the user and token.
+// It must run after OllamaAuth.
+func ModelAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost && c.Request.Method != http.MethodDelete {
+			c.Next()
+			return
+		}
+		if name := RequestModel(c); name != "" && !ModelAllowed(c, name) {
+			AbortWithError(c, http.StatusForbidden, "model_not_allowed",
+				fmt.Sprintf("model \"%s\" is not allowed for this token", name))
+			return
+		}
+		c.Next()
+	}
+}
+
+// model list fields: Ollama lists models under "models" with a "name", OpenAI under "data" with an "id"
+var modelListFields = map[string]string{"models": "name", "data": "id"}
+
+// MergeModelLists joins /api/tags, /api/ps or /v1/models responses of several backends, a model listed by
+// more than one backend appears once.
+func MergeModelLists(bodies [][]byte) ([]byte, error) {
+	var merged map[string]json.RawMessage
+	for field, nameKey := range modelListFields {
+		seen := map[string]bool{}
+		var items []json.RawMessage
+		found := false
+		for _, body := range bodies {
+			var data map[string]json.RawMessage
+			if err := json.Unmarshal(body, &data); err != nil {
+				return nil, err
+			}
+			if merged == nil {
+				merged = data
+			}
+			raw, ok := data[field]
+			if !ok {
+				continue
+			}
+			found = true
+			var list []map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return nil, err
+			}
+			for _, item := range list {
+				var name string
+				_ = json.Unmarshal(item[nameKey], &name)
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				encoded, err := json.Marshal(item)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, encoded)
+			}
+		}
+		if !found {
+			continue
+		}
+		if items == nil {
+			items = []json.RawMessage{}
+		}
+		encoded, err := json.Marshal(items)
+		if err != nil {
+			return nil, err
+		}
+		merged[field] = encoded
+	}
+	return json.Marshal(merged)
+}
+
+// FilterModelList removes the models the caller may not use from an /api/tags, /api/ps or /v1/models response.
+func FilterModelList(c *gin.Context, body []byte) ([]byte, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	for field, nameKey := range modelListFields {
+		raw, ok := data[field]
+		if !ok {
+			continue
+		}
+		var items []map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		filtered := make([]map[string]json.RawMessage, 0, len(items))
+		for _, item := range items {
+			var name string
+			if err := json.Unmarshal(item[nameKey], &name); err == nil && ModelAllowed(c, name) {
+				filtered = append(filtered, item)
+			}
+		}
+		encoded, err := json.Marshal(filtered)
+		if err != nil {
+			return nil, err
+		}
+		data[field] = encoded
+	}
+	return json.Marshal(data)
+}
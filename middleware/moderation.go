@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"safe-ollama/config"
+	"safe-ollama/model"
+	"safe-ollama/moderation"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Moderation runs the prompt of chat and generate requests through the moderation pipeline and records
+// every decision. It must run after OllamaAuth.
+func Moderation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !moderation.Enabled() || c.Request.Method != http.MethodPost {
+			c.Next()
+			return
+		}
+		token := c.MustGet("ollamaToken").(model.OllamaToken)
+		// the classifier may call a model behind this proxy, its own requests must not be moderated again
+		if config.ModerationClassifier.Token != "" && token.Token == config.ModerationClassifier.Token {
+			c.Next()
+			return
+		}
+		data := decodeRequestJSON(c)
+		if data == nil {
+			c.Next()
+			return
+		}
+		text := promptText(data)
+		if text == "" {
+			c.Next()
+			return
+		}
+
+		decision, err := moderation.Check(c.Request.Context(), text)
+		if err != nil {
+			slog.Error("[Moderation] moderator failed", "moderator", decision.Moderator, "error", err)
+			if !config.ModerationClassifier.FailOpen {
+				recordModeration(c, db, token, moderation.Decision{Blocked: true, Moderator: decision.Moderator, Reason: "moderator unavailable"})
+				AbortWithError(c, http.StatusServiceUnavailable, "moderation_unavailable", "content moderation is unavailable, please retry later")
+				return
+			}
+		}
+		recordModeration(c, db, token, decision)
+		if decision.Blocked {
+			slog.Info("[Moderation] request blocked", "user", token.UserId, "token", token.ID,
+				"moderator", decision.Moderator, "reason", decision.Reason)
+			AbortWithError(c, http.StatusBadRequest, "content_policy_violation",
+				"request blocked by content moderation: "+decision.Reason)
+			return
+		}
+		c.Next()
+	}
+}
+
+func recordModeration(c *gin.Context, db *gorm.DB, token model.OllamaToken, decision moderation.Decision) {
+	log := model.ModerationLog{
+		UserId:      token.UserId,
+		TokenId:     token.ID,
+		Path:        c.Request.URL.Path,
+		OllamaModel: RequestModel(c),
+		Blocked:     decision.Blocked,
+		Moderator:   decision.Moderator,
+		Reason:      decision.Reason,
+	}
+	go func() {
+		if err := db.Create(&log).Error; err != nil {
+			slog.Error("[Moderation] fail to create moderation log", "error", err)
+		}
+	}()
+}
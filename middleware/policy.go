@@ -0,0 +1,252 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"safe-ollama/model"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// policyEnforcer applies one policy to a decoded request body and records whether it was changed.
+type policyEnforcer struct {
+	policy  model.RequestPolicy
+	body    map[string]any
+	changed bool
+	// violation is the first reason to reject the request
+	violation string
+}
+
+func (e *policyEnforcer) clampOrReject(field string, value int64, limit int) (int64, bool) {
+	if limit <= 0 || value <= int64(limit) {
+		return value, false
+	}
+	if e.policy.Action == model.POLICY_REJECT {
+		if e.violation == "" {
+			e.violation = fmt.Sprintf("%s %d exceeds the maximum of %d allowed for your account", field, value, limit)
+		}
+		return value, false
+	}
+	e.changed = true
+	return int64(limit), true
+}
+
+func toInt(v any) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, true
+		}
+		if f, err := n.Float64(); err == nil {
+			return int64(f), true
+		}
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// limitInt enforces a limit on an integer field, injecting the limit when inject is set and the field is missing.
+func (e *policyEnforcer) limitInt(obj map[string]any, key string, name string, limit int, inject bool) {
+	if limit <= 0 {
+		return
+	}
+	raw, ok := obj[key]
+	if !ok || raw == nil {
+		// without the field Ollama generates without limit, whatever the action
+		if inject {
+			obj[key] = limit
+			e.changed = true
+		}
+		return
+	}
+	value, ok := toInt(raw)
+	if !ok {
+		return
+	}
+	// a negative num_predict means unlimited generation
+	if value < 0 && key == "num_predict" {
+		if e.policy.Action == model.POLICY_REJECT {
+			if e.violation == "" {
+				e.violation = fmt.Sprintf("%s %d means unlimited generation, the maximum allowed for your account is %d", name, value, limit)
+			}
+			return
+		}
+		obj[key] = limit
+		e.changed = true
+		return
+	}
+	if clamped, changed := e.clampOrReject(name, value, limit); changed {
+		obj[key] = clamped
+	}
+}
+
+// parseKeepAlive returns the keep_alive duration in seconds, negative means forever.
+func parseKeepAlive(v any) (int64, bool) {
+	switch k := v.(type) {
+	case string:
+		if d, err := time.ParseDuration(k); err == nil {
+			return int64(d.Seconds()), true
+		}
+		if i, err := strconv.ParseInt(k, 10, 64); err == nil {
+			return i, true
+		}
+		return 0, false
+	default:
+		return toInt(v)
+	}
+}
+
+func (e *policyEnforcer) limitKeepAlive() {
+	limit := e.policy.MaxKeepAlive
+	if limit <= 0 {
+		return
+	}
+	raw, ok := e.body["keep_alive"]
+	if !ok || raw == nil {
+		return
+	}
+	seconds, ok := parseKeepAlive(raw)
+	if !ok {
+		return
+	}
+	if seconds < 0 {
+		if e.policy.Action == model.POLICY_REJECT {
+			if e.violation == "" {
+				e.violation = fmt.Sprintf("keep_alive %v keeps the model loaded forever, the maximum allowed is %ds", raw, limit)
+			}
+			return
+		}
+		e.body["keep_alive"] = fmt.Sprintf("%ds", limit)
+		e.changed = true
+		return
+	}
+	if _, changed := e.clampOrReject("keep_alive (seconds)", seconds, limit); changed {
+		e.body["keep_alive"] = fmt.Sprintf("%ds", limit)
+	}
+}
+
+// countImages counts base64 images of Ollama requests and image parts of OpenAI messages.
+func countImages(body map[string]any) int {
+	count := 0
+	if images, ok := body["images"].([]any); ok {
+		count += len(images)
+	}
+	messages, _ := body["messages"].([]any)
+	for _, m := range messages {
+		msg, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		if images, ok := msg["images"].([]any); ok {
+			count += len(images)
+		}
+		if parts, ok := msg["content"].([]any); ok {
+			for _, p := range parts {
+				if part, ok := p.(map[string]any); ok && part["type"] == "image_url" {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+func (e *policyEnforcer) enforce(path string) {
+	openAI := strings.HasPrefix(path, "/v1/")
+	if openAI {
+		// clients may send both fields, each is enforced and the limit injected only when both are missing
+		inject := !strings.HasSuffix(path, "embeddings")
+		if _, ok := e.body["max_completion_tokens"]; ok {
+			e.limitInt(e.body, "max_completion_tokens", "max_completion_tokens", e.policy.MaxPredict, false)
+			inject = false
+		}
+		e.limitInt(e.body, "max_tokens", "max_tokens", e.policy.MaxPredict, inject)
+	} else {
+		options, ok := e.body["options"].(map[string]any)
+		if !ok && (e.policy.MaxPredict > 0 || e.policy.MaxNumCtx > 0) {
+			options = map[string]any{}
+		}
+		if options != nil {
+			e.limitInt(options, "num_ctx", "options.num_ctx", e.policy.MaxNumCtx, false)
+			if path == "/api/chat" || path == "/api/generate" {
+				e.limitInt(options, "num_predict", "options.num_predict", e.policy.MaxPredict, true)
+			}
+			if len(options) > 0 {
+				e.body["options"] = options
+			}
+		}
+		e.limitKeepAlive()
+	}
+
+	if limit := e.policy.MaxImages; limit > 0 && e.violation == "" {
+		// images can not be dropped meaningfully, so too many images are always rejected
+		if count := countImages(e.body); count > limit {
+			e.violation = fmt.Sprintf("request contains %d images, the maximum allowed is %d", count, limit)
+		}
+	}
+}
+
+// GetRequestPolicy returns the policy of the user, falling back to the policy of its role.
+func GetRequestPolicy(db *gorm.DB, user model.User) (*model.RequestPolicy, error) {
+	var policies []model.RequestPolicy
+	err := db.Where("user_id = ? OR (user_id = 0 AND role = ?)", user.ID, user.Role).
+		Order("user_id desc").Limit(1).Find(&policies).Error
+	if err != nil || len(policies) == 0 {
+		return nil, err
+	}
+	return &policies[0], nil
+}
+
+// RequestPolicy clamps or rejects request parameters such as num_ctx, num_predict, keep_alive and images
+// according to the policy of the user. It must run after OllamaAuth.
+func RequestPolicy(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost {
+			c.Next()
+			return
+		}
+		user := c.MustGet("user").(model.User)
+		policy, err := GetRequestPolicy(db, user)
+		if err != nil {
+			slog.Error("[Policy] fail to get request policy", "error", err)
+			AbortWithError(c, http.StatusInternalServerError, "internal_error", "failed to check request policy")
+			return
+		}
+		if policy == nil {
+			c.Next()
+			return
+		}
+
+		data := decodeRequestJSON(c)
+		if data == nil {
+			// not a JSON object, leave it to Ollama to reject
+			c.Next()
+			return
+		}
+
+		enforcer := &policyEnforcer{policy: *policy, body: data}
+		enforcer.enforce(apiPath(c))
+		if enforcer.violation != "" {
+			slog.Info("[Policy] request rejected", "user", user.ID, "policy", policy.ID, "reason", enforcer.violation)
+			AbortWithError(c, http.StatusBadRequest, "policy_violation", enforcer.violation)
+			return
+		}
+		if enforcer.changed {
+			rewritten, err := json.Marshal(data)
+			if err != nil {
+				AbortWithError(c, http.StatusInternalServerError, "internal_error", "failed to apply request policy")
+				return
+			}
+			slog.Debug("[Policy] request clamped", "user", user.ID, "policy", policy.ID)
+			SetRequestBody(c, rewritten)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"encoding/json"
+	"safe-ollama/model"
+	"testing"
+)
+
+func TestPolicyEnforcePredict(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    string
+		path      string
+		body      string
+		want      string
+		violation string
+	}{
+		{"reject injects missing num_predict", model.POLICY_REJECT, "/api/chat",
+			`{}`, `{"options":{"num_predict":100}}`, ""},
+		{"clamp injects missing num_predict", model.POLICY_CLAMP, "/api/generate",
+			`{}`, `{"options":{"num_predict":100}}`, ""},
+		{"reject reports the negative value sent", model.POLICY_REJECT, "/api/chat",
+			`{"options":{"num_predict":-1}}`, "",
+			"options.num_predict -1 means unlimited generation, the maximum allowed for your account is 100"},
+		{"clamp replaces a negative value", model.POLICY_CLAMP, "/api/chat",
+			`{"options":{"num_predict":-1}}`, `{"options":{"num_predict":100}}`, ""},
+		{"reject injects missing max_tokens", model.POLICY_REJECT, "/v1/chat/completions",
+			`{}`, `{"max_tokens":100}`, ""},
+		{"both OpenAI fields are clamped", model.POLICY_CLAMP, "/v1/chat/completions",
+			`{"max_completion_tokens":1,"max_tokens":1000000}`, `{"max_completion_tokens":1,"max_tokens":100}`, ""},
+		{"both OpenAI fields are rejected", model.POLICY_REJECT, "/v1/chat/completions",
+			`{"max_completion_tokens":1,"max_tokens":1000000}`, "",
+			"max_tokens 1000000 exceeds the maximum of 100 allowed for your account"},
+		{"max_tokens is not injected beside max_completion_tokens", model.POLICY_CLAMP, "/v1/chat/completions",
+			`{"max_completion_tokens":1}`, `{"max_completion_tokens":1}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]any
+			if err := json.Unmarshal([]byte(tt.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			e := &policyEnforcer{policy: model.RequestPolicy{Action: tt.action, MaxPredict: 100}, body: body}
+			e.enforce(tt.path)
+			if e.violation != tt.violation {
+				t.Fatalf("violation = %q, want %q", e.violation, tt.violation)
+			}
+			if tt.want == "" {
+				return
+			}
+			got, _ := json.Marshal(e.body)
+			if string(got) != tt.want {
+				t.Fatalf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// decodeRequestJSON decodes the request body into a generic object, numbers are kept as json.Number
+// so that re-encoding does not change them. It returns nil if the body is not a JSON object.
+func decodeRequestJSON(c *gin.Context) map[string]any {
+	body, err := RequestBody(c)
+	if err != nil || len(body) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var data map[string]any
+	if err := decoder.Decode(&data); err != nil {
+		return nil
+	}
+	return data
+}
+
+// forEachPromptText calls fn with every prompt text of an Ollama or OpenAI request: system, prompt,
+// message contents and the text parts of multi-part contents. fn returns the replacement text.
+func forEachPromptText(data map[string]any, fn func(string) string) {
+	for _, key := range []string{"system", "prompt", "suffix"} {
+		switch v := data[key].(type) {
+		case string:
+			data[key] = fn(v)
+		case []any:
+			// OpenAI completions accept a list of prompts
+			for i, p := range v {
+				if s, ok := p.(string); ok {
+					v[i] = fn(s)
+				}
+			}
+		}
+	}
+	messages, _ := data["messages"].([]any)
+	for _, m := range messages {
+		msg, ok := m.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch content := msg["content"].(type) {
+		case string:
+			msg["content"] = fn(content)
+		case []any:
+			for _, p := range content {
+				if part, ok := p.(map[string]any); ok {
+					if text, ok := part["text"].(string); ok {
+						part["text"] = fn(text)
+					}
+				}
+			}
+		}
+	}
+}
+
+// promptText joins every prompt text of a request.
+func promptText(data map[string]any) string {
+	var texts []string
+	forEachPromptText(data, func(s string) string {
+		if s != "" {
+			texts = append(texts, s)
+		}
+		return s
+	})
+	return strings.Join(texts, "\n")
+}
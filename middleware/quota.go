@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"safe-ollama/model"
+	"safe-ollama/upstream"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type QuotaAmount struct {
+	Limit     int `json:"limit"`
+	Used      int `json:"used"`
+	Remaining int `json:"remaining"`
+}
+
+type QuotaStatus struct {
+	ID       uint         `json:"id"`
+	Model    string       `json:"model"`
+	Period   string       `json:"period"`
+	ResetAt  time.Time    `json:"resetAt"`
+	Prompt   *QuotaAmount `json:"prompt,omitempty"`
+	Response *QuotaAmount `json:"response,omitempty"`
+	Total    *QuotaAmount `json:"total,omitempty"`
+}
+
+// Exhausted returns a description of the first exhausted budget, or "" if none is.
+func (s QuotaStatus) Exhausted() string {
+	for _, b := range []struct {
+		name   string
+		amount *QuotaAmount
+	}{{"prompt", s.Prompt}, {"response", s.Response}, {"total", s.Total}} {
+		if b.amount != nil && b.amount.Remaining <= 0 {
+			scope := "all models"
+			if s.Model != "" {
+				scope = "model " + s.Model
+			}
+			return fmt.Sprintf("%s %s token quota of %d for %s exhausted, resets at %s",
+				s.Period, b.name, b.amount.Limit, scope, s.ResetAt.Format(time.RFC3339))
+		}
+	}
+	return ""
+}
+
+// PeriodRange returns the start and end of the quota period containing now.
+func PeriodRange(period string, now time.Time) (time.Time, time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch period {
+	case model.QUOTA_WEEKLY:
+		// weeks start on Monday
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7)
+	case model.QUOTA_MONTHLY:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return start, start.AddDate(0, 1, 0)
+	default:
+		return day, day.AddDate(0, 0, 1)
+	}
+}
+
+func newQuotaAmount(limit int, used int) *QuotaAmount {
+	if limit <= 0 {
+		return nil
+	}
+	return &QuotaAmount{Limit: limit, Used: used, Remaining: max(limit-used, 0)}
+}
+
+// GetQuotaStatus computes the consumption of every quota of a user.
+func GetQuotaStatus(db *gorm.DB, userId uint) ([]QuotaStatus, error) {
+	var quotas []model.TokenQuota
+	if err := db.Where("user_id = ?", userId).Find(&quotas).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := make([]QuotaStatus, 0, len(quotas))
+	for _, quota := range quotas {
+		start, end := PeriodRange(quota.Period, now)
+		var used struct {
+			PromptTokens   int
+			ResponseTokens int
+		}
+		usage := db.Model(&model.TokenUsage{}).
+			Select("COALESCE(SUM(prompt_eval_count), 0) as prompt_tokens, COALESCE(SUM(eval_count), 0) as response_tokens").
+			Where("user_id = ? AND cached = ? AND time >= ? AND time < ?", userId, false, start, end)
+		if quota.OllamaModel != "" {
+			usage = usage.Where("ollama_model = ? OR ollama_model = ?", quota.OllamaModel, upstream.NormalizeModel(quota.OllamaModel))
+		}
+		if err := usage.Scan(&used).Error; err != nil {
+			return nil, err
+		}
+
+		result = append(result, QuotaStatus{
+			ID:       quota.ID,
+			Model:    quota.OllamaModel,
+			Period:   quota.Period,
+			ResetAt:  end,
+			Prompt:   newQuotaAmount(quota.PromptLimit, used.PromptTokens),
+			Response: newQuotaAmount(quota.ResponseLimit, used.ResponseTokens),
+			Total:    newQuotaAmount(quota.TotalLimit, used.PromptTokens+used.ResponseTokens),
+		})
+	}
+	return result, nil
+}
+
+// checkQuota aborts the request if any budget that applies to it is used up.
+func checkQuota(c *gin.Context, db *gorm.DB, user model.User) bool {
+	statuses, err := GetQuotaStatus(db, user.ID)
+	if err != nil {
+		slog.Error("[Quota] fail to get quota status", "error", err)
+		AbortWithError(c, http.StatusInternalServerError, "internal_error", "failed to check quota")
+		return false
+	}
+
+	requestModel, modelRead := "", false
+	for _, status := range statuses {
+		if status.Model != "" {
+			if !modelRead {
+				requestModel, modelRead = RequestModel(c), true
+			}
+			if requestModel == "" || upstream.NormalizeModel(status.Model) != upstream.NormalizeModel(requestModel) {
+				continue
+			}
+		}
+		if msg := status.Exhausted(); msg != "" {
+			slog.Info("[Quota] quota exhausted", "user", user.ID, "quota", status.ID)
+			AbortWithError(c, http.StatusTooManyRequests, "insufficient_quota", msg)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"safe-ollama/config"
+	"safe-ollama/model"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const tokenRateRulesKey = "tokenRateRules"
+
+type rateRule struct {
+	scope  string
+	id     uint
+	kind   string // "requests" or "tokens"
+	limit  int
+	period time.Duration
+}
+
+func (r rateRule) key() string {
+	return fmt.Sprintf("%s:%d:%s:%s", r.scope, r.id, r.kind, r.period)
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// rateCounter keeps fixed windows per rule, windows are swept lazily.
+type rateCounter struct {
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+var rates = &rateCounter{windows: make(map[string]*rateWindow)}
+
+type rateState struct {
+	rule      rateRule
+	remaining int
+	reset     time.Duration
+}
+
+// window returns the current window of a rule. Caller holds r.mu.
+func (r *rateCounter) window(rule rateRule, now time.Time) *rateWindow {
+	w, ok := r.windows[rule.key()]
+	if !ok || now.Sub(w.start) >= rule.period {
+		w = &rateWindow{start: now}
+		r.windows[rule.key()] = w
+	}
+	return w
+}
+
+func (r *rateCounter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < 10*time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for key, w := range r.windows {
+		// the longest period is an hour
+		if now.Sub(w.start) >= time.Hour {
+			delete(r.windows, key)
+		}
+	}
+}
+
+// admit checks every rule and counts the request against the request rules if none is exhausted.
+// It returns the state of each rule, and the exhausted one if the request is rejected.
+func (r *rateCounter) admit(rules []rateRule) ([]rateState, *rateState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.sweep(now)
+
+	states := make([]rateState, 0, len(rules))
+	for _, rule := range rules {
+		w := r.window(rule, now)
+		state := rateState{rule: rule, remaining: rule.limit - w.count, reset: w.start.Add(rule.period).Sub(now)}
+		if state.remaining <= 0 {
+			state.remaining = 0
+			return nil, &state
+		}
+		states = append(states, state)
+	}
+	for i, state := range states {
+		if state.rule.kind == "requests" {
+			r.window(state.rule, now).count++
+			states[i].remaining--
+		}
+	}
+	return states, nil
+}
+
+func (r *rateCounter) consume(rules []rateRule, tokens int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, rule := range rules {
+		r.window(rule, now).count += tokens
+	}
+}
+
+// resolveLimit applies the override semantics used for users: positive overrides, negative disables, 0 inherits.
+func resolveLimit(override int, fallback int) int {
+	switch {
+	case override > 0:
+		return override
+	case override < 0:
+		return 0
+	default:
+		return fallback
+	}
+}
+
+func rateRules(user model.User, token model.OllamaToken) []rateRule {
+	role := config.RoleLimits[user.Role]
+	var rules []rateRule
+	add := func(scope string, id uint, kind string, limit int, period time.Duration) {
+		if limit > 0 {
+			rules = append(rules, rateRule{scope: scope, id: id, kind: kind, limit: limit, period: period})
+		}
+	}
+	add("token", token.ID, "requests", token.RequestsPerMinute, time.Minute)
+	add("token", token.ID, "tokens", token.TokensPerMinute, time.Minute)
+	add("token", token.ID, "tokens", token.TokensPerHour, time.Hour)
+	add("user", user.ID, "requests", resolveLimit(user.RequestsPerMinute, role.RequestsPerMinute), time.Minute)
+	add("user", user.ID, "tokens", resolveLimit(user.TokensPerMinute, role.TokensPerMinute), time.Minute)
+	add("user", user.ID, "tokens", resolveLimit(user.TokensPerHour, role.TokensPerHour), time.Hour)
+	return rules
+}
+
+func setRateLimitHeaders(c *gin.Context, states []rateState) {
+	tightest := map[string]*rateState{}
+	for i, state := range states {
+		if t, ok := tightest[state.rule.kind]; !ok || state.remaining < t.remaining {
+			tightest[state.rule.kind] = &states[i]
+		}
+	}
+	for kind, state := range tightest {
+		c.Header("X-RateLimit-Limit-"+kind, strconv.Itoa(state.rule.limit))
+		c.Header("X-RateLimit-Remaining-"+kind, strconv.Itoa(state.remaining))
+		c.Header("X-RateLimit-Reset-"+kind, state.reset.Round(time.Second).String())
+	}
+	if state, ok := tightest["requests"]; ok {
+		c.Header("X-RateLimit-Limit", strconv.Itoa(state.rule.limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(state.remaining))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(state.reset).Unix(), 10))
+	}
+}
+
+// RateLimit enforces requests per minute and generated tokens per minute/hour for tokens and users.
+// Token consumption is recorded by OllamaTokenCount. It must run after OllamaAuth.
+func RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(model.User)
+		token := c.MustGet("ollamaToken").(model.OllamaToken)
+		rules := rateRules(user, token)
+		if len(rules) == 0 {
+			c.Next()
+			return
+		}
+
+		states, exhausted := rates.admit(rules)
+		if exhausted != nil {
+			retryAfter := int(math.Ceil(exhausted.reset.Seconds()))
+			slog.Info("[RateLimit] rate limit reached", "scope", exhausted.rule.scope, "id", exhausted.rule.id,
+				"kind", exhausted.rule.kind, "limit", exhausted.rule.limit, "period", exhausted.rule.period)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			setRateLimitHeaders(c, []rateState{*exhausted})
+			AbortWithError(c, http.StatusTooManyRequests, "rate_limit_exceeded",
+				fmt.Sprintf("rate limit reached: %s limit of %d %s per %s, retry after %ds",
+					exhausted.rule.scope, exhausted.rule.limit, exhausted.rule.kind, exhausted.rule.period, retryAfter))
+			return
+		}
+		setRateLimitHeaders(c, states)
+
+		var tokenRules []rateRule
+		for _, rule := range rules {
+			if rule.kind == "tokens" {
+				tokenRules = append(tokenRules, rule)
+			}
+		}
+		c.Set(tokenRateRulesKey, tokenRules)
+
+		c.Next()
+	}
+}
+
+// recordTokenRate counts generated tokens against the token rate rules of the request.
+func recordTokenRate(c *gin.Context, tokens int) {
+	if rules, ok := c.Get(tokenRateRulesKey); ok && tokens > 0 {
+		rates.consume(rules.([]rateRule), tokens)
+	}
+}
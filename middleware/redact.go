@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"safe-ollama/config"
+	"safe-ollama/model"
+	"safe-ollama/redact"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	redactPassthrough = iota
+	redactNdjson
+	redactSSE
+	redactJSON
+)
+
+// redactWriter masks PII in the generated text of a response. Streams are rewritten frame by frame,
+// the text of each frame is delayed by redact.Holdback bytes so that values split across frames are caught.
+type redactWriter struct {
+	gin.ResponseWriter
+	mode    int
+	decided bool
+	line    []byte
+	body    bytes.Buffer
+	streams map[int]*redact.Stream
+	counts  map[string]int
+}
+
+func (w *redactWriter) stream(index int) *redact.Stream {
+	s, ok := w.streams[index]
+	if !ok {
+		s = redact.NewStream()
+		w.streams[index] = s
+	}
+	return s
+}
+
+func (w *redactWriter) decide() {
+	w.decided = true
+	contentType := w.Header().Get("Content-Type")
+	switch {
+	case w.Status() != http.StatusOK:
+		w.mode = redactPassthrough
+	case strings.Contains(contentType, "application/x-ndjson"):
+		w.mode = redactNdjson
+	case strings.Contains(contentType, "text/event-stream"):
+		w.mode = redactSSE
+	case strings.Contains(contentType, "application/json"):
+		w.mode = redactJSON
+	}
+	if w.mode != redactPassthrough {
+		w.Header().Del("Content-Length")
+	}
+}
+
+func (w *redactWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decide()
+	}
+	switch w.mode {
+	case redactPassthrough:
+		return w.ResponseWriter.Write(b)
+	case redactJSON:
+		return w.body.Write(b)
+	}
+	w.line = append(w.line, b...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := w.ResponseWriter.Write(w.rewriteLine(w.line[:i+1])); err != nil {
+			return 0, err
+		}
+		w.line = w.line[i+1:]
+	}
+	return len(b), nil
+}
+
+func (w *redactWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// finish writes whatever is still buffered once the handler returned.
+func (w *redactWriter) finish() {
+	switch w.mode {
+	case redactJSON:
+		body := w.body.Bytes()
+		if rewritten, ok := w.rewriteJSON(body); ok {
+			body = rewritten
+		}
+		_, _ = w.ResponseWriter.Write(body)
+	case redactNdjson, redactSSE:
+		if len(w.line) > 0 {
+			_, _ = w.ResponseWriter.Write(w.rewriteLine(w.line))
+		}
+	}
+}
+
+func decodeObject(b []byte) map[string]any {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var data map[string]any
+	if err := decoder.Decode(&data); err != nil {
+		return nil
+	}
+	return data
+}
+
+// rewriteLine redacts one ndjson line or SSE line, lines that can not be parsed are passed through.
+func (w *redactWriter) rewriteLine(line []byte) []byte {
+	trimmed := bytes.TrimRight(line, "\r\n")
+	suffix := line[len(trimmed):]
+	payload := trimmed
+	if w.mode == redactSSE {
+		if !bytes.HasPrefix(trimmed, []byte("data:")) {
+			return line
+		}
+		payload = bytes.TrimSpace(trimmed[len("data:"):])
+	}
+	data := decodeObject(payload)
+	if data == nil {
+		return line
+	}
+
+	if w.mode == redactNdjson {
+		done, _ := data["done"].(bool)
+		if msg, ok := data["message"].(map[string]any); ok {
+			msg["content"] = w.pushText(0, msg["content"], done)
+		} else if _, ok := data["response"]; ok {
+			data["response"] = w.pushText(0, data["response"], done)
+		}
+	} else {
+		choices, _ := data["choices"].([]any)
+		for i, ch := range choices {
+			choice, ok := ch.(map[string]any)
+			if !ok {
+				continue
+			}
+			index := i
+			if n, ok := toInt(choice["index"]); ok {
+				index = int(n)
+			}
+			finished := choice["finish_reason"] != nil
+			if delta, ok := choice["delta"].(map[string]any); ok {
+				if _, has := delta["content"]; has || finished {
+					delta["content"] = w.pushText(index, delta["content"], finished)
+				}
+			} else if _, ok := choice["text"]; ok {
+				choice["text"] = w.pushText(index, choice["text"], finished)
+			}
+		}
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return line
+	}
+	if w.mode == redactSSE {
+		encoded = append([]byte("data: "), encoded...)
+	}
+	return append(encoded, suffix...)
+}
+
+func (w *redactWriter) pushText(index int, v any, final bool) string {
+	text, _ := v.(string)
+	s := w.stream(index)
+	out := s.Push(text)
+	if final {
+		out += s.Flush()
+	}
+	return out
+}
+
+// rewriteJSON redacts a non streamed Ollama or OpenAI response.
+func (w *redactWriter) rewriteJSON(body []byte) ([]byte, bool) {
+	data := decodeObject(body)
+	if data == nil {
+		return nil, false
+	}
+	if msg, ok := data["message"].(map[string]any); ok {
+		if text, ok := msg["content"].(string); ok {
+			msg["content"] = redact.Text(text, w.counts)
+		}
+	}
+	if text, ok := data["response"].(string); ok {
+		data["response"] = redact.Text(text, w.counts)
+	}
+	choices, _ := data["choices"].([]any)
+	for _, ch := range choices {
+		choice, ok := ch.(map[string]any)
+		if !ok {
+			continue
+		}
+		if msg, ok := choice["message"].(map[string]any); ok {
+			if text, ok := msg["content"].(string); ok {
+				msg["content"] = redact.Text(text, w.counts)
+			}
+		}
+		if text, ok := choice["text"].(string); ok {
+			choice["text"] = redact.Text(text, w.counts)
+		}
+	}
+	encoded, err := json.Marshal(data)
+	return encoded, err == nil
+}
+
+// Redaction masks PII in the prompt before it is forwarded and, if enabled, in the generated response.
+// Every redaction is recorded as a RedactionEvent. It must run after OllamaAuth.
+func Redaction(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !redact.Enabled() || c.Request.Method != http.MethodPost {
+			c.Next()
+			return
+		}
+		token := c.MustGet("ollamaToken").(model.OllamaToken)
+
+		requestCounts := make(map[string]int)
+		if data := decodeRequestJSON(c); data != nil {
+			forEachPromptText(data, func(s string) string {
+				return redact.Text(s, requestCounts)
+			})
+			if len(requestCounts) > 0 {
+				if body, err := json.Marshal(data); err == nil {
+					SetRequestBody(c, body)
+				}
+			}
+		}
+
+		var writer *redactWriter
+		if config.RedactionResponse {
+			writer = &redactWriter{ResponseWriter: c.Writer, streams: make(map[int]*redact.Stream), counts: make(map[string]int)}
+			c.Writer = writer
+		}
+
+		c.Next()
+
+		responseCounts := map[string]int{}
+		if writer != nil {
+			writer.finish()
+			c.Writer = writer.ResponseWriter
+			responseCounts = writer.counts
+			for _, s := range writer.streams {
+				for kind, n := range s.Counts {
+					responseCounts[kind] += n
+				}
+			}
+		}
+		recordRedactions(c, db, token, "request", requestCounts)
+		recordRedactions(c, db, token, "response", responseCounts)
+	}
+}
+
+func recordRedactions(c *gin.Context, db *gorm.DB, token model.OllamaToken, direction string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	events := make([]model.RedactionEvent, 0, len(counts))
+	for kind, n := range counts {
+		events = append(events, model.RedactionEvent{
+			UserId:    token.UserId,
+			TokenId:   token.ID,
+			Path:      c.Request.URL.Path,
+			Direction: direction,
+			Type:      kind,
+			Count:     n,
+		})
+	}
+	slog.Info("[Redact] values redacted", "user", token.UserId, "token", token.ID, "direction", direction, "counts", counts)
+	go func() {
+		if err := db.Create(&events).Error; err != nil {
+			slog.Error("[Redact] fail to create redaction events", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"safe-ollama/config"
+	"safe-ollama/redact"
+	"strings"
+	"testing"
+)
+
+func withRedaction(t *testing.T, detectors ...string) {
+	t.Helper()
+	oldEnabled, oldDetectors, oldCustom := config.RedactionEnabled, config.RedactionDetectors, config.RedactionCustom
+	config.RedactionEnabled = true
+	config.RedactionDetectors = detectors
+	config.RedactionCustom = nil
+	redact.Init()
+	t.Cleanup(func() {
+		config.RedactionEnabled, config.RedactionDetectors, config.RedactionCustom = oldEnabled, oldDetectors, oldCustom
+		redact.Init()
+	})
+}
+
+func TestRedactRewriteLine(t *testing.T) {
+	withRedaction(t, "email")
+	// the first frame releases "aé" only, the cut falls inside "é"
+	multiByte := "aé" + strings.Repeat("b", redact.Holdback-1)
+
+	tests := []struct {
+		name  string
+		mode  int
+		lines []string
+		want  []string
+	}{
+		{"ndjson chat match split across frames", redactNdjson,
+			[]string{
+				`{"message":{"role":"assistant","content":"mail bob@exa"},"done":false}`,
+				`{"message":{"role":"assistant","content":"mple.com now"},"done":false}`,
+				`{"message":{"role":"assistant","content":""},"done":true,"eval_count":3}`,
+			},
+			[]string{
+				`{"done":false,"message":{"content":"","role":"assistant"}}`,
+				`{"done":false,"message":{"content":"","role":"assistant"}}`,
+				`{"done":true,"eval_count":3,"message":{"content":"mail [REDACTED_EMAIL] now","role":"assistant"}}`,
+			}},
+		{"ndjson generate flushed on done", redactNdjson,
+			[]string{
+				`{"response":"to alice@","done":false}`,
+				`{"response":"example.org","done":true}`,
+			},
+			[]string{
+				`{"done":false,"response":""}`,
+				`{"done":true,"response":"to [REDACTED_EMAIL]"}`,
+			}},
+		{"ndjson multi-byte boundary", redactNdjson,
+			[]string{
+				`{"response":"` + multiByte + `","done":false}`,
+				`{"response":"","done":true}`,
+			},
+			[]string{
+				`{"done":false,"response":"aé"}`,
+				`{"done":true,"response":"` + strings.Repeat("b", redact.Holdback-1) + `"}`,
+			}},
+		{"sse chat flushed on finish_reason", redactSSE,
+			[]string{
+				`data: {"choices":[{"index":0,"delta":{"content":"ask carol@exa"},"finish_reason":null}]}`,
+				`data: {"choices":[{"index":0,"delta":{"content":"mple.net"},"finish_reason":null}]}`,
+				`data: {"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+				`data: [DONE]`,
+			},
+			[]string{
+				`data: {"choices":[{"delta":{"content":""},"finish_reason":null,"index":0}]}`,
+				`data: {"choices":[{"delta":{"content":""},"finish_reason":null,"index":0}]}`,
+				`data: {"choices":[{"delta":{"content":"ask [REDACTED_EMAIL]"},"finish_reason":"stop","index":0}]}`,
+				`data: [DONE]`,
+			}},
+		{"sse choices are redacted separately", redactSSE,
+			[]string{
+				`data: {"choices":[{"index":0,"text":"dave@"},{"index":1,"text":"plain"}]}`,
+				`data: {"choices":[{"index":1,"text":" text","finish_reason":"stop"},{"index":0,"text":"example.com","finish_reason":"stop"}]}`,
+			},
+			[]string{
+				`data: {"choices":[{"index":0,"text":""},{"index":1,"text":""}]}`,
+				`data: {"choices":[{"finish_reason":"stop","index":1,"text":"plain text"},{"finish_reason":"stop","index":0,"text":"[REDACTED_EMAIL]"}]}`,
+			}},
+		{"lines that are not frames pass through", redactSSE,
+			[]string{`: keep-alive`, `event: ping`, `data: not json`},
+			[]string{`: keep-alive`, `event: ping`, `data: not json`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &redactWriter{mode: tt.mode, streams: make(map[int]*redact.Stream), counts: make(map[string]int)}
+			for i, line := range tt.lines {
+				got := string(w.rewriteLine([]byte(line + "\n")))
+				if got != tt.want[i]+"\n" {
+					t.Fatalf("line %d = %s, want %s", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestBodyKey      = "requestBody"
+	requestBodyErrorKey = "requestBodyError"
+	rawBodyKey          = "rawBody"
+)
+
+// BodyLimit rejects request bodies larger than limit with 413. The body is only read by ReadBody, after the
+// client is authenticated. A negative limit marks a raw body, such as a model blob, that is streamed upstream
+// unread: RequestBody returns nothing for it.
+func BodyLimit(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit < 0 {
+			c.Set(rawBodyKey, true)
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			AbortWithError(c, http.StatusRequestEntityTooLarge, "request_too_large",
+				fmt.Sprintf("request body exceeds %d bytes", limit))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// ReadBody reads the request body up front, so that later middlewares share it. It must run after BodyLimit.
+func ReadBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := RequestBody(c); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				AbortWithError(c, http.StatusRequestEntityTooLarge, "request_too_large",
+					fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			} else {
+				AbortWithError(c, http.StatusBadRequest, "invalid_request", "failed to read request body")
+			}
+			return
+		}
+		c.Next()
+	}
+}
+
+// RawBody reports whether the request body is streamed upstream without being read.
+func RawBody(c *gin.Context) bool {
+	return c.GetBool(rawBodyKey)
+}
+
+// RequestBody reads the request body once and caches it in the context, c.Request.Body is replaced
+// so that it can still be forwarded upstream.
+func RequestBody(c *gin.Context) ([]byte, error) {
+	if body, ok := c.Get(requestBodyKey); ok {
+		return body.([]byte), nil
+	}
+	if err, ok := c.Get(requestBodyErrorKey); ok {
+		return nil, err.(error)
+	}
+	if c.Request.Body == nil || RawBody(c) {
+		return nil, nil
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	_ = c.Request.Body.Close()
+	if err != nil {
+		// the body is gone, later reads get the same error
+		c.Set(requestBodyErrorKey, err)
+		return nil, err
+	}
+	SetRequestBody(c, body)
+	return body, nil
+}
+
+// SetRequestBody replaces the body that will be forwarded upstream.
+func SetRequestBody(c *gin.Context, body []byte) {
+	c.Set(requestBodyKey, body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+}
+
+// RequestModel returns the "model" field of a JSON request body, falling back to the legacy "name" field,
+// or "" if there is none.
+func RequestModel(c *gin.Context) string {
+	body, err := RequestBody(c)
+	if err != nil || len(body) == 0 {
+		return ""
+	}
+	var data struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return ""
+	}
+	if data.Model == "" {
+		return data.Name
+	}
+	return data.Model
+}
@@ -0,0 +1,442 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type responsesRequest struct {
+	Model              string          `json:"model"`
+	Instructions       string          `json:"instructions"`
+	Input              json.RawMessage `json:"input"`
+	Tools              []responsesTool `json:"tools"`
+	Stream             bool            `json:"stream"`
+	MaxOutputTokens    int             `json:"max_output_tokens"`
+	Temperature        *float64        `json:"temperature"`
+	TopP               *float64        `json:"top_p"`
+	PreviousResponseID string          `json:"previous_response_id"`
+	Text               *struct {
+		Format *struct {
+			Type   string          `json:"type"`
+			Schema json.RawMessage `json:"schema"`
+		} `json:"format"`
+	} `json:"text"`
+}
+
+type responsesItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+	// function_call
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	// function_call_output
+	Output json.RawMessage `json:"output"`
+}
+
+type responsesPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL string `json:"image_url"`
+}
+
+type responsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// responsesParts reads item content, which is either a string or a list of content parts.
+func responsesParts(raw json.RawMessage) ([]responsesPart, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []responsesPart{{Type: "input_text", Text: text}}, nil
+	}
+	var parts []responsesPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, errors.New("content must be a string or a list of content parts")
+	}
+	return parts, nil
+}
+
+// appendPart adds a text or image part to an Ollama message.
+func appendPart(msg *ollamaMessage, part responsesPart) error {
+	switch part.Type {
+	case "input_text", "output_text", "text":
+		if msg.Content != "" {
+			msg.Content += "\n"
+		}
+		msg.Content += part.Text
+	case "input_image":
+		// data:image/png;base64,...
+		_, data, ok := strings.Cut(part.ImageURL, ";base64,")
+		if !ok || !strings.HasPrefix(part.ImageURL, "data:") {
+			return errors.New("only base64 data URLs are supported for images")
+		}
+		msg.Images = append(msg.Images, data)
+	default:
+		return fmt.Errorf("unsupported content part type \"%s\"", part.Type)
+	}
+	return nil
+}
+
+// responsesToOllama translates a Responses API request into an Ollama /api/chat request.
+func responsesToOllama(body []byte) (*responsesRequest, []byte, error) {
+	var req responsesRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nil, errors.New("request body is not a valid Responses API request")
+	}
+	if req.Model == "" {
+		return nil, nil, errors.New("model: field required")
+	}
+	if req.PreviousResponseID != "" {
+		return nil, nil, errors.New("previous_response_id is not supported, send the whole conversation as input")
+	}
+
+	var messages []ollamaMessage
+	if req.Instructions != "" {
+		messages = append(messages, ollamaMessage{Role: "system", Content: req.Instructions})
+	}
+
+	var items []responsesItem
+	var input string
+	if err := json.Unmarshal(req.Input, &input); err == nil {
+		items = []responsesItem{{Type: "message", Role: "user", Content: req.Input}}
+	} else if err := json.Unmarshal(req.Input, &items); err != nil || len(items) == 0 {
+		return nil, nil, errors.New("input: must be a string or a list of input items")
+	}
+
+	// function call outputs only carry the id of the call, Ollama wants the name of the tool
+	toolNames := map[string]string{}
+	for i, item := range items {
+		switch item.Type {
+		case "message", "":
+			role := item.Role
+			switch role {
+			case "developer":
+				role = "system"
+			case "user", "assistant", "system":
+			default:
+				return nil, nil, fmt.Errorf("input.%d.role: unsupported role \"%s\"", i, item.Role)
+			}
+			parts, err := responsesParts(item.Content)
+			if err != nil {
+				return nil, nil, fmt.Errorf("input.%d.content: %w", i, err)
+			}
+			msg := ollamaMessage{Role: role}
+			for _, part := range parts {
+				if err := appendPart(&msg, part); err != nil {
+					return nil, nil, fmt.Errorf("input.%d.content: %w", i, err)
+				}
+			}
+			messages = append(messages, msg)
+		case "function_call":
+			if !json.Valid([]byte(item.Arguments)) {
+				return nil, nil, fmt.Errorf("input.%d.arguments: must be a JSON object", i)
+			}
+			toolNames[item.CallID] = item.Name
+			call := newToolCall(item.Name, json.RawMessage(item.Arguments))
+			// consecutive calls belong to the same assistant turn
+			if last := len(messages) - 1; last >= 0 && messages[last].Role == "assistant" && messages[last].Content == "" {
+				messages[last].ToolCalls = append(messages[last].ToolCalls, call)
+			} else {
+				messages = append(messages, ollamaMessage{Role: "assistant", ToolCalls: []ollamaToolCall{call}})
+			}
+		case "function_call_output":
+			parts, err := responsesParts(item.Output)
+			if err != nil {
+				return nil, nil, fmt.Errorf("input.%d.output: %w", i, err)
+			}
+			msg := ollamaMessage{Role: "tool", ToolName: toolNames[item.CallID]}
+			for _, part := range parts {
+				if err := appendPart(&msg, part); err != nil {
+					return nil, nil, fmt.Errorf("input.%d.output: %w", i, err)
+				}
+			}
+			messages = append(messages, msg)
+		case "reasoning":
+			// earlier reasoning is not replayed to Ollama
+		default:
+			return nil, nil, fmt.Errorf("input.%d.type: unsupported item type \"%s\"", i, item.Type)
+		}
+	}
+
+	chat := gin.H{
+		"model":    req.Model,
+		"messages": messages,
+		"stream":   req.Stream,
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]gin.H, 0, len(req.Tools))
+		for i, tool := range req.Tools {
+			if tool.Type != "function" {
+				return nil, nil, fmt.Errorf("tools.%d.type: unsupported tool type \"%s\"", i, tool.Type)
+			}
+			tools = append(tools, gin.H{"type": "function", "function": gin.H{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"parameters":  tool.Parameters,
+			}})
+		}
+		chat["tools"] = tools
+	}
+	if req.Text != nil && req.Text.Format != nil {
+		switch req.Text.Format.Type {
+		case "json_object":
+			chat["format"] = "json"
+		case "json_schema":
+			if len(req.Text.Format.Schema) == 0 {
+				return nil, nil, errors.New("text.format.schema: field required")
+			}
+			chat["format"] = req.Text.Format.Schema
+		case "text", "":
+		default:
+			return nil, nil, fmt.Errorf("text.format.type: unsupported format \"%s\"", req.Text.Format.Type)
+		}
+	}
+	options := gin.H{}
+	if req.MaxOutputTokens > 0 {
+		options["num_predict"] = req.MaxOutputTokens
+	}
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		options["top_p"] = *req.TopP
+	}
+	if len(options) > 0 {
+		chat["options"] = options
+	}
+	translated, err := json.Marshal(chat)
+	return &req, translated, err
+}
+
+// responsesTranslator answers with a Responses API response, or its semantic events when streaming:
+// response.created, response.output_item.*, response.output_text.*, response.function_call_arguments.* and
+// response.completed.
+type responsesTranslator struct {
+	id      string
+	created int64
+	req     *responsesRequest
+	model   string
+	seq     int
+	started bool
+	output  []gin.H
+	// the message item being streamed
+	messageID string
+	text      strings.Builder
+}
+
+func (t *responsesTranslator) event(w *chatWriter, name string, data gin.H) error {
+	data["type"] = name
+	data["sequence_number"] = t.seq
+	t.seq++
+	return w.event(name, data)
+}
+
+func (t *responsesTranslator) response(status string, resp *ollamaChatResponse) gin.H {
+	output := t.output
+	if output == nil {
+		output = []gin.H{}
+	}
+	tools := append([]responsesTool{}, t.req.Tools...)
+	r := gin.H{
+		"id":                  t.id,
+		"object":              "response",
+		"created_at":          t.created,
+		"status":              status,
+		"model":               t.model,
+		"output":              output,
+		"error":               nil,
+		"incomplete_details":  nil,
+		"instructions":        nil,
+		"tools":               tools,
+		"tool_choice":         "auto",
+		"parallel_tool_calls": true,
+		"usage":               nil,
+	}
+	if t.req.Instructions != "" {
+		r["instructions"] = t.req.Instructions
+	}
+	if status == "incomplete" {
+		r["incomplete_details"] = gin.H{"reason": "max_output_tokens"}
+	}
+	if resp != nil {
+		r["usage"] = gin.H{
+			"input_tokens":          resp.PromptEvalCount,
+			"input_tokens_details":  gin.H{"cached_tokens": 0},
+			"output_tokens":         resp.EvalCount,
+			"output_tokens_details": gin.H{"reasoning_tokens": 0},
+			"total_tokens":          resp.PromptEvalCount + resp.EvalCount,
+		}
+	}
+	return r
+}
+
+func responsesStatus(resp ollamaChatResponse) string {
+	if resp.DoneReason == "length" {
+		return "incomplete"
+	}
+	return "completed"
+}
+
+func messageItem(id string, text string) gin.H {
+	return gin.H{
+		"type":    "message",
+		"id":      id,
+		"status":  "completed",
+		"role":    "assistant",
+		"content": []gin.H{outputText(text)},
+	}
+}
+
+func outputText(text string) gin.H {
+	return gin.H{"type": "output_text", "text": text, "annotations": []any{}}
+}
+
+func functionCallItem(call ollamaToolCall) gin.H {
+	return gin.H{
+		"type":      "function_call",
+		"id":        randomID("fc_"),
+		"call_id":   randomID("call_"),
+		"name":      call.Function.Name,
+		"arguments": string(call.arguments()),
+		"status":    "completed",
+	}
+}
+
+func (t *responsesTranslator) closeMessage(w *chatWriter) error {
+	if t.messageID == "" {
+		return nil
+	}
+	id, text, index := t.messageID, t.text.String(), len(t.output)
+	t.messageID = ""
+	t.text.Reset()
+	if err := t.event(w, "response.output_text.done", gin.H{"item_id": id, "output_index": index,
+		"content_index": 0, "text": text}); err != nil {
+		return err
+	}
+	if err := t.event(w, "response.content_part.done", gin.H{"item_id": id, "output_index": index,
+		"content_index": 0, "part": outputText(text)}); err != nil {
+		return err
+	}
+	item := messageItem(id, text)
+	t.output = append(t.output, item)
+	return t.event(w, "response.output_item.done", gin.H{"output_index": index, "item": item})
+}
+
+func (t *responsesTranslator) frame(w *chatWriter, resp ollamaChatResponse) error {
+	if !t.started {
+		t.started = true
+		t.model = resp.Model
+		if err := t.event(w, "response.created", gin.H{"response": t.response("in_progress", nil)}); err != nil {
+			return err
+		}
+		if err := t.event(w, "response.in_progress", gin.H{"response": t.response("in_progress", nil)}); err != nil {
+			return err
+		}
+	}
+
+	if resp.Message.Content != "" {
+		index := len(t.output)
+		if t.messageID == "" {
+			t.messageID = randomID("msg_")
+			if err := t.event(w, "response.output_item.added", gin.H{"output_index": index, "item": gin.H{
+				"type": "message", "id": t.messageID, "status": "in_progress", "role": "assistant", "content": []any{},
+			}}); err != nil {
+				return err
+			}
+			if err := t.event(w, "response.content_part.added", gin.H{"item_id": t.messageID, "output_index": index,
+				"content_index": 0, "part": outputText("")}); err != nil {
+				return err
+			}
+		}
+		t.text.WriteString(resp.Message.Content)
+		if err := t.event(w, "response.output_text.delta", gin.H{"item_id": t.messageID, "output_index": index,
+			"content_index": 0, "delta": resp.Message.Content}); err != nil {
+			return err
+		}
+	}
+	// Ollama sends tool calls whole
+	for _, call := range resp.Message.ToolCalls {
+		if err := t.closeMessage(w); err != nil {
+			return err
+		}
+		item, index := functionCallItem(call), len(t.output)
+		added := gin.H{}
+		for k, v := range item {
+			added[k] = v
+		}
+		added["arguments"] = ""
+		added["status"] = "in_progress"
+		if err := t.event(w, "response.output_item.added", gin.H{"output_index": index, "item": added}); err != nil {
+			return err
+		}
+		if err := t.event(w, "response.function_call_arguments.delta", gin.H{"item_id": item["id"],
+			"output_index": index, "delta": item["arguments"]}); err != nil {
+			return err
+		}
+		if err := t.event(w, "response.function_call_arguments.done", gin.H{"item_id": item["id"],
+			"output_index": index, "arguments": item["arguments"]}); err != nil {
+			return err
+		}
+		t.output = append(t.output, item)
+		if err := t.event(w, "response.output_item.done", gin.H{"output_index": index, "item": item}); err != nil {
+			return err
+		}
+	}
+
+	if !resp.Done {
+		return nil
+	}
+	if err := t.closeMessage(w); err != nil {
+		return err
+	}
+	status := responsesStatus(resp)
+	return t.event(w, "response."+status, gin.H{"response": t.response(status, &resp)})
+}
+
+func (t *responsesTranslator) message(resp ollamaChatResponse) any {
+	t.model = resp.Model
+	if resp.Message.Content != "" {
+		t.output = append(t.output, messageItem(randomID("msg_"), resp.Message.Content))
+	}
+	for _, call := range resp.Message.ToolCalls {
+		t.output = append(t.output, functionCallItem(call))
+	}
+	return t.response(responsesStatus(resp), &resp)
+}
+
+// OpenAIResponses serves the OpenAI Responses API on top of Ollama /api/chat. Responses are not stored, so
+// previous_response_id is rejected and clients send the whole conversation.
+func OpenAIResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := RequestBody(c)
+		if err != nil {
+			AbortWithError(c, http.StatusBadRequest, "invalid_request", "failed to read request body")
+			return
+		}
+		req, translated, err := responsesToOllama(body)
+		if err != nil {
+			AbortWithError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		translateChat(c, translated, req.Stream, &responsesTranslator{
+			id:      randomID("resp_"),
+			created: time.Now().Unix(),
+			req:     req,
+			model:   req.Model,
+		})
+	}
+}
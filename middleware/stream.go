@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"bytes"
+	"strings"
+)
+
+const (
+	streamNone = iota
+	streamNdjson
+	streamSSE
+)
+
+// streamKind tells ndjson and SSE streams apart by the response content type.
+func streamKind(contentType string) int {
+	switch {
+	case strings.Contains(contentType, "application/x-ndjson"):
+		return streamNdjson
+	case strings.Contains(contentType, "text/event-stream"):
+		return streamSSE
+	default:
+		return streamNone
+	}
+}
+
+// frameScanner splits a stream into frames as bytes arrive: ndjson lines, or the payload of SSE "data:" lines.
+// Only the current incomplete line is buffered.
+type frameScanner struct {
+	kind    int
+	line    []byte
+	onFrame func(payload []byte)
+}
+
+func (s *frameScanner) Write(b []byte) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			s.line = append(s.line, b...)
+			return
+		}
+		if len(s.line) > 0 {
+			s.line = append(s.line, b[:i]...)
+			s.frame(s.line)
+			s.line = s.line[:0]
+		} else {
+			s.frame(b[:i])
+		}
+		b = b[i+1:]
+	}
+}
+
+// Close handles a last frame that was not terminated by a newline.
+func (s *frameScanner) Close() {
+	if len(s.line) > 0 {
+		s.frame(s.line)
+		s.line = nil
+	}
+}
+
+func (s *frameScanner) frame(line []byte) {
+	line = bytes.TrimSpace(line)
+	if s.kind == streamSSE {
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			return
+		}
+		line = bytes.TrimSpace(line[len("data:"):])
+	}
+	if len(line) > 0 {
+		s.onFrame(line)
+	}
+}
+
+// frameText returns the generated text carried by an Ollama or OpenAI response or stream frame.
+func frameText(data map[string]any) string {
+	var builder strings.Builder
+	if msg, ok := data["message"].(map[string]any); ok {
+		if text, ok := msg["content"].(string); ok {
+			builder.WriteString(text)
+		}
+	}
+	if text, ok := data["response"].(string); ok {
+		builder.WriteString(text)
+	}
+	choices, _ := data["choices"].([]any)
+	for _, ch := range choices {
+		choice, ok := ch.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"delta", "message"} {
+			if msg, ok := choice[key].(map[string]any); ok {
+				if text, ok := msg["content"].(string); ok {
+					builder.WriteString(text)
+				}
+			}
+		}
+		if text, ok := choice["text"].(string); ok {
+			builder.WriteString(text)
+		}
+	}
+	return builder.String()
+}
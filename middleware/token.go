@@ -3,60 +3,335 @@ package middleware
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"io"
 	"log/slog"
 	"net/http"
 	"safe-ollama/model"
-	"strings"
+	"safe-ollama/upstream"
 )
 
-type bodyLogWriter struct {
+type usageData struct {
+	Model           string `json:"model"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	// OpenAI compatible responses report usage with different field names
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// usageWriter parses the response as it is written to the client. Streams are split into frames and only
+// the last frame carrying token counts is kept, so memory stays constant however long the generation runs.
+type usageWriter struct {
 	gin.ResponseWriter
-	body *bytes.Buffer
+	scanner *frameScanner
+	decoder *usageDecoder
+	skip    bool // errors carry no usage
+	last    []byte
+	frames  int
+	// strip drops the OpenAI usage chunk that was requested on behalf of the client
+	strip     bool
+	pending   []byte
+	dropBlank bool
 }
 
-func (w bodyLogWriter) Write(b []byte) (int, error) {
-	w.body.Write(b)
+func (w *usageWriter) Write(b []byte) (int, error) {
+	if w.scanner == nil && w.decoder == nil && !w.skip {
+		if w.Status() != http.StatusOK {
+			w.skip = true
+		} else if kind := streamKind(w.Header().Get("Content-Type")); kind != streamNone {
+			w.scanner = &frameScanner{kind: kind, onFrame: w.onFrame}
+			w.strip = w.strip && kind == streamSSE
+		} else {
+			w.decoder = newUsageDecoder()
+		}
+	}
+	if w.scanner != nil {
+		w.scanner.Write(b)
+		if w.strip {
+			return w.writeStripped(b)
+		}
+	} else if w.decoder != nil {
+		w.decoder.Write(b)
+	}
 	return w.ResponseWriter.Write(b)
 }
 
-func OllamaTokenCount(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		blw := &bodyLogWriter{
-			body:           bytes.NewBufferString(""),
-			ResponseWriter: c.Writer,
+func (w *usageWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// writeStripped forwards complete SSE lines, leaving out the usage chunk and the blank line ending its event.
+func (w *usageWriter) writeStripped(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			w.pending = append(w.pending, b...)
+			break
 		}
-		c.Writer = blw
-		c.Next()
-		if c.Writer.Status() != http.StatusOK {
-			return
+		line := b[:i+1]
+		if len(w.pending) > 0 {
+			line = append(w.pending, line...)
+			w.pending = w.pending[:0]
 		}
+		b = b[i+1:]
 
-		isStream := strings.Contains(c.Writer.Header().Get("Content-Type"), "application/x-ndjson")
-		var data struct {
-			Model           string `json:"model"`
-			PromptEvalCount int    `json:"prompt_eval_count"`
-			EvalCount       int    `json:"eval_count"`
+		trimmed := bytes.TrimSpace(line)
+		if w.dropBlank && len(trimmed) == 0 {
+			w.dropBlank = false
+			continue
 		}
+		w.dropBlank = false
+		if isUsageChunk(trimmed) {
+			w.dropBlank = true
+			continue
+		}
+		if _, err := w.ResponseWriter.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
 
-		if isStream {
-			chunks := bytes.Split(blw.body.Bytes(), []byte("\n"))
-			if len(chunks) < 2 {
-				slog.Error("[Ollama Token] chunks length less than 2")
-				return
-			}
-			chunk := chunks[len(chunks)-2]
-			slog.Debug("[Ollama Token]", "body", string(chunk))
-			if err := json.Unmarshal(chunk, &data); err != nil {
-				slog.Error("[Ollama Token] fail to parse response body", "error", err)
-				return
-			}
-		} else {
-			if err := json.Unmarshal(blw.body.Bytes(), &data); err != nil {
-				slog.Error("[Ollama Token] fail to parse response body", "error", err)
-				return
+// isUsageChunk reports whether an SSE line is the trailing chunk that only carries usage.
+func isUsageChunk(line []byte) bool {
+	if !bytes.HasPrefix(line, []byte("data:")) || !bytes.Contains(line, []byte(`"usage"`)) {
+		return false
+	}
+	var chunk struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   json.RawMessage   `json:"usage"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(line[len("data:"):]), &chunk); err != nil {
+		return false
+	}
+	return len(chunk.Choices) == 0 && len(chunk.Usage) > 0 && string(chunk.Usage) != "null"
+}
+
+func (w *usageWriter) onFrame(payload []byte) {
+	if !bytes.Equal(payload, []byte("[DONE]")) {
+		w.frames++
+	}
+	// only the final frame carries token counts, "[DONE]" and trailing data are ignored
+	if bytes.Contains(payload, []byte(`"eval_count"`)) || bytes.Contains(payload, []byte(`"prompt_eval_count"`)) ||
+		bytes.Contains(payload, []byte(`"prompt_tokens"`)) {
+		w.last = append(w.last[:0], payload...)
+	}
+}
+
+// usage returns the token counts of the response, or false if it carried none.
+func (w *usageWriter) usage() (usageData, bool) {
+	var data usageData
+	switch {
+	case w.decoder != nil:
+		var err error
+		if data, err = w.decoder.Close(); err != nil {
+			slog.Error("[Ollama Token] fail to parse response body", "error", err)
+			return data, false
+		}
+	case w.scanner != nil:
+		w.scanner.Close()
+		if len(w.pending) > 0 {
+			_, _ = w.ResponseWriter.Write(w.pending)
+			w.pending = nil
+		}
+		if len(w.last) == 0 {
+			return data, false
+		}
+		slog.Debug("[Ollama Token]", "body", string(w.last))
+		if err := json.Unmarshal(w.last, &data); err != nil {
+			slog.Error("[Ollama Token] fail to parse response body", "error", err)
+			return data, false
+		}
+	default:
+		return data, false
+	}
+	if data.Usage != nil {
+		data.PromptEvalCount = data.Usage.PromptTokens
+		data.EvalCount = data.Usage.CompletionTokens
+	}
+	return data, true
+}
+
+const usageStatusKey = "usageStatus"
+
+// SetUsageStatus marks a request that reached Ollama but did not complete normally, its usage is recorded
+// from what was streamed so far.
+func SetUsageStatus(c *gin.Context, status string) {
+	c.Set(usageStatusKey, status)
+}
+
+// estimateTokens approximates the token count of a text at four bytes per token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// usageDecoder reads the top level fields of a JSON response as it is written and skips everything else
+// token by token, so large embedding responses are never held in memory.
+type usageDecoder struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	data usageData
+	err  error
+}
+
+func newUsageDecoder() *usageDecoder {
+	pr, pw := io.Pipe()
+	d := &usageDecoder{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		d.err = decodeUsage(pr, &d.data)
+		// keep draining so writes never block after a parse error
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	return d
+}
+
+func (d *usageDecoder) Write(b []byte) {
+	_, _ = d.pw.Write(b)
+}
+
+func (d *usageDecoder) Close() (usageData, error) {
+	_ = d.pw.Close()
+	<-d.done
+	return d.data, d.err
+}
+
+func decodeUsage(r io.Reader, data *usageData) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("response is not a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "model":
+			err = dec.Decode(&data.Model)
+		case "prompt_eval_count":
+			err = dec.Decode(&data.PromptEvalCount)
+		case "eval_count":
+			err = dec.Decode(&data.EvalCount)
+		case "usage":
+			err = dec.Decode(&data.Usage)
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// embeddingInputs counts the texts of an embedding request, "input" may be a string, a list of strings,
+// a token array or a list of token arrays.
+func embeddingInputs(c *gin.Context) int {
+	data := decodeRequestJSON(c)
+	if data == nil {
+		return 0
+	}
+	input, ok := data["input"]
+	if !ok {
+		// legacy /api/embeddings takes a single prompt
+		if _, ok := data["prompt"]; ok {
+			return 1
+		}
+		return 0
+	}
+	list, ok := input.([]any)
+	if !ok {
+		return 1
+	}
+	if len(list) > 0 {
+		if _, ok := list[0].(json.Number); ok {
+			return 1
+		}
+	}
+	return len(list)
+}
+
+// requestStreamUsage makes streamed OpenAI completions report usage in a final chunk by setting
+// stream_options.include_usage. It returns true if the option was added and the chunk should be stripped.
+func requestStreamUsage(c *gin.Context) bool {
+	if path := c.FullPath(); path != "/v1/chat/completions" && path != "/v1/completions" {
+		return false
+	}
+	data := decodeRequestJSON(c)
+	if data == nil {
+		return false
+	}
+	if stream, _ := data["stream"].(bool); !stream {
+		return false
+	}
+	options, ok := data["stream_options"].(map[string]any)
+	if !ok {
+		options = map[string]any{}
+	}
+	if include, _ := options["include_usage"].(bool); include {
+		return false
+	}
+	options["include_usage"] = true
+	data["stream_options"] = options
+	body, err := json.Marshal(data)
+	if err != nil {
+		return false
+	}
+	SetRequestBody(c, body)
+	return true
+}
+
+// OllamaTokenCount records the usage of the response under kind, one of the model.USAGE_KIND_* values.
+func OllamaTokenCount(db *gorm.DB, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writer := &usageWriter{ResponseWriter: c.Writer, strip: requestStreamUsage(c)}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		status := c.GetString(usageStatusKey)
+		data, ok := writer.usage()
+		switch {
+		case ok:
+			// the final frame arrived, whatever happened afterwards
+			status = model.USAGE_STATUS_COMPLETED
+		case status == "":
+			return
+		default:
+			data = usageData{
+				Model:           RequestModel(c),
+				PromptEvalCount: estimateTokens(promptText(decodeRequestJSON(c))),
+				EvalCount:       writer.frames,
 			}
+			slog.Info("[Ollama Token] recording partial usage", "status", status, "model", data.Model, "frames", writer.frames)
 		}
 
 		obj, ok := c.Get("ollamaToken")
@@ -66,13 +341,41 @@ func OllamaTokenCount(db *gorm.DB) gin.HandlerFunc {
 		}
 		token := obj.(model.OllamaToken)
 
-		if data.Model != "" && (data.PromptEvalCount > 0 || data.EvalCount > 0) {
+		inputs := 1
+		if kind == model.USAGE_KIND_EMBEDDING {
+			inputs = embeddingInputs(c)
+			// the legacy endpoint answers with the vector only
+			if data.Model == "" {
+				data.Model = RequestModel(c)
+			}
+			if data.PromptEvalCount == 0 {
+				data.PromptEvalCount = estimateTokens(promptText(decodeRequestJSON(c)))
+			}
+		}
+
+		cached := c.GetBool(cacheHitKey)
+		if !cached {
+			if kind == model.USAGE_KIND_EMBEDDING {
+				recordTokenRate(c, data.PromptEvalCount)
+			} else {
+				recordTokenRate(c, data.EvalCount)
+			}
+		}
+
+		// requests name models as the client sent them, "llama3" and "llama3:latest" must add up to one model
+		data.Model = upstream.NormalizeModel(data.Model)
+		if data.Model != "" && (data.PromptEvalCount > 0 || data.EvalCount > 0 ||
+			kind == model.USAGE_KIND_EMBEDDING || status != model.USAGE_STATUS_COMPLETED) {
 			go func() {
 				tokenUsage := model.TokenUsage{
 					UserId:          token.UserId,
 					OllamaModel:     data.Model,
 					PromptEvalCount: data.PromptEvalCount,
 					EvalCount:       data.EvalCount,
+					RequestKind:     kind,
+					Inputs:          inputs,
+					Status:          status,
+					Cached:          cached,
 				}
 				if err := db.Create(&tokenUsage).Error; err != nil {
 					slog.Error("[Ollama Token] fail to create token usage", "error", err)
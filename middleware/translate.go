@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the Ollama route a translated request body is written for
+const apiPathKey = "apiPath"
+
+// apiPath returns the API the request body is written for, which differs from the route for translated requests.
+func apiPath(c *gin.Context) string {
+	if path := c.GetString(apiPathKey); path != "" {
+		return path
+	}
+	return c.FullPath()
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+func newToolCall(name string, arguments json.RawMessage) ollamaToolCall {
+	call := ollamaToolCall{}
+	call.Function.Name = name
+	call.Function.Arguments = arguments
+	if len(arguments) == 0 {
+		call.Function.Arguments = json.RawMessage("{}")
+	}
+	return call
+}
+
+// arguments returns the arguments of a call, which Ollama may leave out.
+func (call ollamaToolCall) arguments() json.RawMessage {
+	if len(call.Function.Arguments) == 0 || string(call.Function.Arguments) == "null" {
+		return json.RawMessage("{}")
+	}
+	return call.Function.Arguments
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+}
+
+func randomID(prefix string) string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// chatTranslator converts Ollama /api/chat responses into the API a route speaks.
+type chatTranslator interface {
+	// frame writes the events for a frame of a streamed response
+	frame(w *chatWriter, resp ollamaChatResponse) error
+	// message returns the whole response
+	message(resp ollamaChatResponse) any
+}
+
+// chatWriter translates the Ollama /api/chat response written through it. Error responses are already in the
+// shape of the route's API and pass through.
+type chatWriter struct {
+	gin.ResponseWriter
+	translator chatTranslator
+	stream     bool
+	body       bytes.Buffer // the whole response, or the incomplete line of a stream
+	wrote      bool
+	finished   bool
+}
+
+func (w *chatWriter) passThrough() bool {
+	return w.Status() != http.StatusOK
+}
+
+func (w *chatWriter) Write(b []byte) (int, error) {
+	if w.passThrough() {
+		return w.ResponseWriter.Write(b)
+	}
+	w.body.Write(b)
+	if !w.stream {
+		return len(b), nil
+	}
+	for {
+		i := bytes.IndexByte(w.body.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := append([]byte(nil), w.body.Next(i+1)...)
+		if err := w.frame(bytes.TrimSpace(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *chatWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush holds back the headers of the Ollama response until translated output is written.
+func (w *chatWriter) Flush() {
+	if w.wrote || w.passThrough() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *chatWriter) output(b []byte) error {
+	if !w.wrote {
+		w.wrote = true
+		header := w.Header()
+		header.Del("Content-Length")
+		if w.stream {
+			header.Set("Content-Type", "text/event-stream")
+			header.Set("Cache-Control", "no-cache")
+		} else {
+			header.Set("Content-Type", "application/json")
+		}
+	}
+	_, err := w.ResponseWriter.Write(b)
+	return err
+}
+
+// event writes a server-sent event.
+func (w *chatWriter) event(name string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return w.output([]byte("event: " + name + "\ndata: " + string(payload) + "\n\n"))
+}
+
+func (w *chatWriter) frame(line []byte) error {
+	if len(line) == 0 || w.finished {
+		return nil
+	}
+	var resp ollamaChatResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		slog.Error("[Translate] fail to parse response frame", "error", err)
+		return nil
+	}
+	w.finished = resp.Done
+	return w.translator.frame(w, resp)
+}
+
+// finish writes what is left once the response has been read: the trailing frame of a stream or the whole
+// translated response.
+func (w *chatWriter) finish() {
+	if w.passThrough() {
+		return
+	}
+	if w.stream {
+		if w.body.Len() > 0 {
+			_ = w.frame(bytes.TrimSpace(w.body.Bytes()))
+		}
+		return
+	}
+	if w.body.Len() == 0 {
+		return
+	}
+	var resp ollamaChatResponse
+	if err := json.Unmarshal(w.body.Bytes(), &resp); err != nil {
+		slog.Error("[Translate] fail to parse response body", "error", err)
+		_ = w.output(w.body.Bytes())
+		return
+	}
+	body, err := json.Marshal(w.translator.message(resp))
+	if err != nil {
+		slog.Error("[Translate] fail to encode response", "error", err)
+		return
+	}
+	_ = w.output(body)
+}
+
+// translateChat forwards the request to Ollama /api/chat with the translated body and translates the response
+// back. The body is replaced before the policy, usage and cache middlewares see it, so they handle the request
+// as an /api/chat request.
+func translateChat(c *gin.Context, body []byte, stream bool, translator chatTranslator) {
+	SetRequestBody(c, body)
+	c.Set(apiPathKey, "/api/chat")
+
+	writer := &chatWriter{ResponseWriter: c.Writer, translator: translator, stream: stream}
+	c.Writer = writer
+	c.Next()
+	c.Writer = writer.ResponseWriter
+	writer.finish()
+}
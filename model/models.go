@@ -10,20 +10,78 @@ const (
 	USER_ROLE  = "user"
 )
 
+const (
+	SCOPE_INFERENCE    = "inference"
+	SCOPE_EMBEDDINGS   = "embeddings"
+	SCOPE_MODELS_READ  = "models:read"
+	SCOPE_MODELS_WRITE = "models:write"
+)
+
+const (
+	USAGE_KIND_GENERATE   = "generate"
+	USAGE_KIND_CHAT       = "chat"
+	USAGE_KIND_COMPLETION = "completion"
+	USAGE_KIND_EMBEDDING  = "embedding"
+)
+
+const (
+	USAGE_STATUS_COMPLETED      = "completed"
+	USAGE_STATUS_CANCELLED      = "cancelled"
+	USAGE_STATUS_UPSTREAM_ERROR = "upstream_error"
+	USAGE_STATUS_TIMEOUT        = "timeout"
+)
+
+var (
+	AllScopes = []string{SCOPE_INFERENCE, SCOPE_EMBEDDINGS, SCOPE_MODELS_READ, SCOPE_MODELS_WRITE}
+	// DefaultScopes applies to tokens created without scopes, including those created before scopes existed
+	DefaultScopes = []string{SCOPE_INFERENCE, SCOPE_EMBEDDINGS, SCOPE_MODELS_READ}
+)
+
 type User struct {
-	ID       uint   `gorm:"primaryKey; autoIncrement"`
-	Username string `gorm:"not null; index:user_username_index"`
-	Password string `gorm:"not null"`
-	Salt     string `gorm:"not null"`
-	Role     string `gorm:"not null"`
+	ID           uint   `gorm:"primaryKey; autoIncrement"`
+	Username     string `gorm:"not null; index:user_username_index"`
+	Password     string `gorm:"not null"`
+	Salt         string `gorm:"not null"`
+	Role         string `gorm:"not null"`
+	AuditEnabled bool   `gorm:"not null; default:false"`
+	// limits below use the role default when 0, negative means unlimited
+	MaxConcurrent     int `gorm:"not null; default:0"`
+	RequestsPerMinute int `gorm:"not null; default:0"`
+	TokensPerMinute   int `gorm:"not null; default:0"`
+	TokensPerHour     int `gorm:"not null; default:0"`
+	// model name patterns the user may call, empty allows every model
+	AllowedModels []string `gorm:"serializer:json"`
 }
 
 type OllamaToken struct {
-	ID        uint      `gorm:"primaryKey; autoIncrement"`
-	Name      string    `gorm:"not null"`
-	Token     string    `gorm:"not null; uniqueIndex:ollama_token_token_index"`
-	UserId    uint      `gorm:"not null; index:ollama_token_user_id_index"`
-	CreatedAt time.Time `gorm:"autoCreateTime"`
+	ID           uint      `gorm:"primaryKey; autoIncrement"`
+	Name         string    `gorm:"not null"`
+	Token        string    `gorm:"not null; uniqueIndex:ollama_token_token_index"`
+	UserId       uint      `gorm:"not null; index:ollama_token_user_id_index"`
+	CreatedAt    time.Time `gorm:"autoCreateTime"`
+	AuditEnabled bool      `gorm:"not null; default:false"`
+	// limits below are not applied when 0
+	MaxConcurrent     int `gorm:"not null; default:0"`
+	RequestsPerMinute int `gorm:"not null; default:0"`
+	TokensPerMinute   int `gorm:"not null; default:0"`
+	TokensPerHour     int `gorm:"not null; default:0"`
+	// narrows the models of the user, empty inherits them
+	AllowedModels []string `gorm:"serializer:json"`
+	Scopes        []string `gorm:"serializer:json"`
+}
+
+// HasScope reports whether the token grants the scope, tokens without scopes get DefaultScopes.
+func (t *OllamaToken) HasScope(scope string) bool {
+	scopes := t.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
 type TokenUsage struct {
@@ -33,9 +91,92 @@ type TokenUsage struct {
 	Time            time.Time `gorm:"autoCreateTime; index:token_usage_time,"`
 	PromptEvalCount int
 	EvalCount       int
+	RequestKind     string `gorm:"not null; default:''"`
+	// number of texts embedded in one request, 1 for generations
+	Inputs int `gorm:"not null; default:0"`
+	// counts of unfinished requests are estimated from the streamed chunks and the prompt length
+	Status string `gorm:"not null; default:'completed'"`
+	// served from the response cache, excluded from quotas and usage statistics
+	Cached bool `gorm:"not null; default:false"`
+}
+
+const (
+	QUOTA_DAILY   = "daily"
+	QUOTA_WEEKLY  = "weekly"
+	QUOTA_MONTHLY = "monthly"
+)
+
+// TokenQuota is a token budget of a user over a period, limits of 0 are not enforced.
+type TokenQuota struct {
+	ID            uint      `gorm:"primaryKey; autoIncrement"`
+	UserId        uint      `gorm:"not null; index:token_quota_user_id_index"`
+	OllamaModel   string    `gorm:"not null; default:''"` // empty applies to all models
+	Period        string    `gorm:"not null"`
+	PromptLimit   int       `gorm:"not null; default:0"`
+	ResponseLimit int       `gorm:"not null; default:0"`
+	TotalLimit    int       `gorm:"not null; default:0"`
+	CreatedAt     time.Time `gorm:"autoCreateTime"`
+}
+
+const (
+	POLICY_CLAMP  = "clamp"
+	POLICY_REJECT = "reject"
+)
+
+// RequestPolicy limits request parameters of a role, or of a single user when UserId is set.
+// Limits of 0 are not enforced.
+type RequestPolicy struct {
+	ID     uint   `gorm:"primaryKey; autoIncrement"`
+	Role   string `gorm:"not null; default:''"`
+	UserId uint   `gorm:"not null; default:0; index:request_policy_user_id_index"`
+	// clamp rewrites values over the limit, reject refuses the request
+	Action       string `gorm:"not null; default:'clamp'"`
+	MaxNumCtx    int    `gorm:"not null; default:0"`
+	MaxPredict   int    `gorm:"not null; default:0"` // num_predict, max_tokens
+	MaxKeepAlive int    `gorm:"not null; default:0"` // seconds, also forbids keeping models loaded forever
+	MaxImages    int    `gorm:"not null; default:0"`
+}
+
+type ModerationLog struct {
+	ID          uint      `gorm:"primarykey"`
+	UserId      uint      `gorm:"not null; index:moderation_log_user_id_index"`
+	TokenId     uint      `gorm:"not null"`
+	Path        string    `gorm:"not null"`
+	OllamaModel string    `gorm:"not null; default:''"`
+	Blocked     bool      `gorm:"not null"`
+	Moderator   string    `gorm:"not null; default:''"`
+	Reason      string    `gorm:"not null; default:''"`
+	Time        time.Time `gorm:"autoCreateTime; index:moderation_log_time"`
+}
+
+// RedactionEvent counts the values of one type masked in a request or response, the values are not stored.
+type RedactionEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	UserId    uint      `gorm:"not null; index:redaction_event_user_id_index"`
+	TokenId   uint      `gorm:"not null"`
+	Path      string    `gorm:"not null"`
+	Direction string    `gorm:"not null"` // request or response
+	Type      string    `gorm:"not null"`
+	Count     int       `gorm:"not null"`
+	Time      time.Time `gorm:"autoCreateTime; index:redaction_event_time"`
+}
+
+// AuditRecord captures one proxied request and the text of its response for compliance review.
+type AuditRecord struct {
+	ID          uint      `gorm:"primarykey"`
+	UserId      uint      `gorm:"not null; index:audit_record_user_id_index"`
+	TokenId     uint      `gorm:"not null; index:audit_record_token_id_index"`
+	Path        string    `gorm:"not null"`
+	OllamaModel string    `gorm:"not null; default:''"`
+	Prompt      string    `gorm:"not null; default:''"` // JSON of the messages, prompt or input
+	Response    string    `gorm:"not null; default:''"` // generated text, streams are reassembled
+	Status      int       `gorm:"not null"`
+	Truncated   bool      `gorm:"not null; default:false"`
+	DurationMs  int64     `gorm:"not null"`
+	Time        time.Time `gorm:"autoCreateTime; index:audit_record_time"`
 }
 
 func InitModels(db *gorm.DB) error {
-	err := db.AutoMigrate(&User{}, &OllamaToken{}, &TokenUsage{})
+	err := db.AutoMigrate(&User{}, &OllamaToken{}, &TokenUsage{}, &TokenQuota{}, &RequestPolicy{}, &ModerationLog{}, &RedactionEvent{}, &AuditRecord{})
 	return err
 }
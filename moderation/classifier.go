@@ -0,0 +1,80 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"safe-ollama/config"
+	"strings"
+	"time"
+)
+
+// classifierModerator asks a guard model such as llama-guard3 through the Ollama /api/chat API,
+// usually another model behind this proxy. Answers starting with the blocked prefix block the prompt.
+type classifierModerator struct {
+	client *http.Client
+}
+
+func newClassifierModerator() *classifierModerator {
+	return &classifierModerator{
+		client: &http.Client{Timeout: time.Duration(config.ModerationClassifier.Timeout) * time.Second},
+	}
+}
+
+func (m *classifierModerator) Name() string {
+	return "classifier"
+}
+
+func (m *classifierModerator) Check(ctx context.Context, text string) (Decision, error) {
+	cfg := config.ModerationClassifier
+	payload, err := json.Marshal(map[string]any{
+		"model":    cfg.Model,
+		"messages": []map[string]string{{"role": "user", "content": text}},
+		"stream":   false,
+	})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("classifier returned %s", resp.Status)
+	}
+
+	var data struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return Decision{}, err
+	}
+	answer := strings.TrimSpace(data.Message.Content)
+	if strings.HasPrefix(strings.ToLower(answer), strings.ToLower(cfg.BlockedPrefix)) {
+		// llama-guard style answers carry the violated categories on the following lines
+		reason := strings.TrimSpace(answer[len(cfg.BlockedPrefix):])
+		if reason == "" {
+			reason = "flagged by classifier"
+		} else {
+			reason = "flagged by classifier: " + strings.ReplaceAll(reason, "\n", ", ")
+		}
+		return Decision{Blocked: true, Moderator: m.Name(), Reason: reason}, nil
+	}
+	return Decision{Moderator: m.Name()}, nil
+}
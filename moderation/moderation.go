@@ -0,0 +1,109 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"safe-ollama/config"
+	"strings"
+)
+
+type Decision struct {
+	Blocked   bool
+	Moderator string
+	Reason    string
+}
+
+// Moderator inspects the text of a prompt and decides whether it may be forwarded.
+type Moderator interface {
+	Name() string
+	Check(ctx context.Context, text string) (Decision, error)
+}
+
+var pipeline []Moderator
+
+// Init builds the moderation pipeline from config, invalid patterns are skipped.
+func Init() {
+	pipeline = nil
+	if !config.ModerationEnabled {
+		return
+	}
+	if len(config.ModerationKeywords) > 0 {
+		pipeline = append(pipeline, &keywordModerator{keywords: config.ModerationKeywords})
+	}
+	if len(config.ModerationPatterns) > 0 {
+		m := &regexModerator{}
+		for _, p := range config.ModerationPatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				slog.Error("[Moderation] invalid pattern", "pattern", p, "error", err)
+				continue
+			}
+			m.patterns = append(m.patterns, re)
+		}
+		pipeline = append(pipeline, m)
+	}
+	if config.ModerationClassifier.URL != "" {
+		pipeline = append(pipeline, newClassifierModerator())
+	}
+	slog.Info("[Moderation] pipeline initialized", "moderators", len(pipeline))
+}
+
+// Register appends a moderator to the pipeline.
+func Register(m Moderator) {
+	pipeline = append(pipeline, m)
+}
+
+func Enabled() bool {
+	return len(pipeline) > 0
+}
+
+// Check runs the pipeline in order and stops at the first moderator that blocks the text.
+func Check(ctx context.Context, text string) (Decision, error) {
+	for _, m := range pipeline {
+		decision, err := m.Check(ctx, text)
+		if err != nil {
+			return Decision{Moderator: m.Name()}, err
+		}
+		if decision.Blocked {
+			return decision, nil
+		}
+	}
+	return Decision{}, nil
+}
+
+type keywordModerator struct {
+	keywords []string
+}
+
+func (m *keywordModerator) Name() string {
+	return "keyword"
+}
+
+func (m *keywordModerator) Check(_ context.Context, text string) (Decision, error) {
+	lower := strings.ToLower(text)
+	for _, k := range m.keywords {
+		if k != "" && strings.Contains(lower, strings.ToLower(k)) {
+			return Decision{Blocked: true, Moderator: m.Name(), Reason: fmt.Sprintf("matched keyword %q", k)}, nil
+		}
+	}
+	return Decision{Moderator: m.Name()}, nil
+}
+
+type regexModerator struct {
+	patterns []*regexp.Regexp
+}
+
+func (m *regexModerator) Name() string {
+	return "regex"
+}
+
+func (m *regexModerator) Check(_ context.Context, text string) (Decision, error) {
+	for _, re := range m.patterns {
+		if re.MatchString(text) {
+			return Decision{Blocked: true, Moderator: m.Name(), Reason: fmt.Sprintf("matched pattern %q", re.String())}, nil
+		}
+	}
+	return Decision{Moderator: m.Name()}, nil
+}
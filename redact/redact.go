@@ -0,0 +1,235 @@
+package redact
+
+import (
+	"log/slog"
+	"regexp"
+	"regexp/syntax"
+	"safe-ollama/config"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type detector struct {
+	name    string
+	pattern *regexp.Regexp
+	// validate filters false positives, nil accepts every match
+	validate func(string) bool
+}
+
+type Match struct {
+	Start int
+	End   int
+	Type  string
+}
+
+var builtinDetectors = map[string]func() detector{
+	"email": func() detector {
+		// bounded so that a streamed address always fits the holdback, local parts are at most 64 bytes by RFC 5321
+		return detector{name: "email", pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]{1,64}@[A-Za-z0-9.-]{1,160}\.[A-Za-z]{2,24}`)}
+	},
+	"phone": func() detector {
+		return detector{name: "phone", pattern: regexp.MustCompile(`(?:\+\d{1,3}[\s-]?)?(?:\b1[3-9]\d{9}\b|\(?\b\d{3}\)?[\s.-]\d{3}[\s.-]\d{4}\b)`)}
+	},
+	"credit_card": func() detector {
+		return detector{name: "credit_card", pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), validate: luhn}
+	},
+	"national_id": func() detector {
+		// 18 digit resident identity numbers and US social security numbers
+		return detector{name: "national_id", pattern: regexp.MustCompile(`\b\d{17}[\dXx]\b|\b\d{3}-\d{2}-\d{4}\b`), validate: nationalId}
+	},
+}
+
+var detectors []detector
+
+// Init builds the detectors enabled in config.
+func Init() {
+	detectors = nil
+	if !config.RedactionEnabled {
+		return
+	}
+	// national ids and card numbers go first so that their digits are not taken for phone numbers
+	for _, name := range []string{"national_id", "credit_card", "email", "phone"} {
+		for _, enabled := range config.RedactionDetectors {
+			if enabled == name {
+				detectors = append(detectors, builtinDetectors[name]())
+			}
+		}
+	}
+	for _, custom := range config.RedactionCustom {
+		re, err := regexp.Compile(custom.Pattern)
+		if err != nil {
+			slog.Error("[Redact] invalid custom pattern", "name", custom.Name, "error", err)
+			continue
+		}
+		detectors = append(detectors, detector{name: custom.Name, pattern: re})
+	}
+	for _, d := range detectors {
+		if n := maxLength(d.pattern.String()); n < 0 || n > Holdback {
+			slog.Warn("[Redact] pattern may match values longer than the stream holdback, "+
+				"such values can be released unmasked when split across frames", "name", d.name, "holdback", Holdback)
+		}
+	}
+	slog.Info("[Redact] detectors initialized", "detectors", len(detectors))
+}
+
+// maxLength returns the longest match of pattern in bytes, or -1 if it is unbounded.
+func maxLength(pattern string) int {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return -1
+	}
+	return maxNodeLength(re)
+}
+
+func maxNodeLength(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		n := 0
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 {
+				// a folded rune may be longer, like the Kelvin sign for k
+				n += utf8.UTFMax
+			} else {
+				n += utf8.RuneLen(r)
+			}
+		}
+		return n
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return 0
+		}
+		// ranges are sorted, the last one holds the largest rune
+		return utf8.RuneLen(min(re.Rune[len(re.Rune)-1], utf8.MaxRune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return utf8.UTFMax
+	case syntax.OpCapture, syntax.OpQuest:
+		return maxNodeLength(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus:
+		return -1
+	case syntax.OpRepeat:
+		n := maxNodeLength(re.Sub[0])
+		if re.Max < 0 || n < 0 {
+			return -1
+		}
+		return re.Max * n
+	case syntax.OpConcat, syntax.OpAlternate:
+		total := 0
+		for _, sub := range re.Sub {
+			n := maxNodeLength(sub)
+			if n < 0 {
+				return -1
+			}
+			if re.Op == syntax.OpConcat {
+				total += n
+			} else {
+				total = max(total, n)
+			}
+		}
+		return total
+	default:
+		// empty matches and assertions
+		return 0
+	}
+}
+
+func Enabled() bool {
+	return len(detectors) > 0
+}
+
+// Find returns the non-overlapping matches of every detector ordered by position,
+// earlier detectors win overlaps.
+func Find(text string) []Match {
+	var matches []Match
+	for _, d := range detectors {
+		for _, loc := range d.pattern.FindAllStringIndex(text, -1) {
+			if d.validate != nil && !d.validate(text[loc[0]:loc[1]]) {
+				continue
+			}
+			overlaps := false
+			for _, m := range matches {
+				if loc[0] < m.End && m.Start < loc[1] {
+					overlaps = true
+					break
+				}
+			}
+			if !overlaps {
+				matches = append(matches, Match{Start: loc[0], End: loc[1], Type: d.name})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+	return matches
+}
+
+func Mask(kind string) string {
+	return "[REDACTED_" + strings.ToUpper(kind) + "]"
+}
+
+// Apply replaces the matches with their masks and counts them by type into counts.
+func Apply(text string, matches []Match, counts map[string]int) string {
+	if len(matches) == 0 {
+		return text
+	}
+	var builder strings.Builder
+	last := 0
+	for _, m := range matches {
+		builder.WriteString(text[last:m.Start])
+		builder.WriteString(Mask(m.Type))
+		last = m.End
+		if counts != nil {
+			counts[m.Type]++
+		}
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+// Text masks every match in text and counts them by type into counts.
+func Text(text string, counts map[string]int) string {
+	return Apply(text, Find(text), counts)
+}
+
+func digits(s string) []int {
+	var result []int
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			result = append(result, int(r-'0'))
+		}
+	}
+	return result
+}
+
+func luhn(s string) bool {
+	d := digits(s)
+	if len(d) < 13 || len(d) > 19 {
+		return false
+	}
+	sum := 0
+	for i := len(d) - 1; i >= 0; i-- {
+		v := d[i]
+		if (len(d)-1-i)%2 == 1 {
+			v *= 2
+			if v > 9 {
+				v -= 9
+			}
+		}
+		sum += v
+	}
+	return sum%10 == 0
+}
+
+func nationalId(s string) bool {
+	if len(s) != 18 {
+		// SSN format
+		return true
+	}
+	weights := []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i := 0; i < 17; i++ {
+		sum += int(s[i]-'0') * weights[i]
+	}
+	return "10X98765432"[sum%11] == strings.ToUpper(s[17:])[0]
+}
@@ -0,0 +1,55 @@
+package redact
+
+// Stream redacts text that arrives in pieces. It holds back the last Holdback bytes so that a match split
+// across pieces is complete before any of it is released.
+type Stream struct {
+	pending string
+	Counts  map[string]int
+}
+
+// Holdback must be at least as long as the longest value a detector can match, Init warns about patterns
+// that do not fit. It covers the longest email address of 254 bytes.
+const Holdback = 256
+
+func NewStream() *Stream {
+	return &Stream{Counts: make(map[string]int)}
+}
+
+// Push adds a piece of text and returns the redacted text that is safe to release.
+func (s *Stream) Push(text string) string {
+	s.pending += text
+	cut := len(s.pending) - Holdback
+	if cut <= 0 {
+		return ""
+	}
+	matches := Find(s.pending)
+	var released []Match
+	for _, m := range matches {
+		if m.Start >= cut {
+			break
+		}
+		if m.End > cut {
+			// never cut through a match, it is complete since it started more than Holdback bytes ago
+			cut = m.End
+		}
+		released = append(released, m)
+	}
+	// keep multi-byte characters whole
+	for cut < len(s.pending) && !isRuneStart(s.pending[cut]) {
+		cut++
+	}
+	out := Apply(s.pending[:cut], released, s.Counts)
+	s.pending = s.pending[cut:]
+	return out
+}
+
+// Flush releases everything still held back.
+func (s *Stream) Flush() string {
+	out := Text(s.pending, s.Counts)
+	s.pending = ""
+	return out
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
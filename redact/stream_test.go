@@ -0,0 +1,120 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func withDetectors(t *testing.T, names ...string) {
+	t.Helper()
+	old := detectors
+	detectors = nil
+	for _, name := range names {
+		detectors = append(detectors, builtinDetectors[name]())
+	}
+	t.Cleanup(func() { detectors = old })
+}
+
+// chunk splits text into pieces of n bytes, cutting through multi-byte characters.
+func chunk(text string, n int) []string {
+	var pieces []string
+	for len(text) > n {
+		pieces = append(pieces, text[:n])
+		text = text[n:]
+	}
+	return append(pieces, text)
+}
+
+func TestStreamPush(t *testing.T) {
+	withDetectors(t, "email")
+	padding := strings.Repeat("x", Holdback)
+	chinese := strings.Repeat("你好，世界。", 20)
+	// the longest address the detector takes, 250 bytes
+	longest := strings.Repeat("l", 64) + "@" + strings.Repeat("d", 160) + "." + strings.Repeat("t", 24)
+
+	tests := []struct {
+		name   string
+		pieces []string
+		want   string
+		counts int
+	}{
+		{"match split across pieces",
+			[]string{"write to bob@exa", "mple.com today " + padding},
+			"write to [REDACTED_EMAIL] today " + padding, 1},
+		{"match split into single bytes",
+			chunk("mail alice@example.org now "+padding, 1),
+			"mail [REDACTED_EMAIL] now " + padding, 1},
+		{"match released before flush",
+			[]string{"carol@example.net " + padding + padding},
+			"[REDACTED_EMAIL] " + padding + padding, 1},
+		{"match held back until flush",
+			[]string{"short ", "dave@example.com"},
+			"short [REDACTED_EMAIL]", 1},
+		{"multi-byte characters cut between pieces",
+			chunk(chinese, 7),
+			chinese, 0},
+		{"longest address split across pieces",
+			chunk("to "+longest+" ok", 7),
+			"to [REDACTED_EMAIL] ok", 1},
+		{"local part longer than an address allows",
+			// only the last 64 bytes can be a local part, the stream masks exactly what Text does
+			[]string{"hi " + strings.Repeat("a", 80), "@example.com bye"},
+			"hi " + strings.Repeat("a", 16) + "[REDACTED_EMAIL] bye", 1},
+		{"multi-byte characters around a match",
+			chunk(chinese+"erin@example.com"+chinese, 5),
+			chinese + "[REDACTED_EMAIL]" + chinese, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStream()
+			var out strings.Builder
+			for i, piece := range tt.pieces {
+				released := s.Push(piece)
+				if !utf8.ValidString(released) {
+					t.Fatalf("piece %d: released invalid UTF-8 %q", i, released)
+				}
+				out.WriteString(released)
+			}
+			out.WriteString(s.Flush())
+			// released text is never taken back, so any unmasked part of a value shows up here
+			if out.String() != tt.want {
+				t.Fatalf("output = %q, want %q", out.String(), tt.want)
+			}
+			if whole := Text(strings.Join(tt.pieces, ""), nil); out.String() != whole {
+				t.Fatalf("output = %q, differs from the unsplit text %q", out.String(), whole)
+			}
+			if s.Counts["email"] != tt.counts {
+				t.Fatalf("counts = %v, want %d email", s.Counts, tt.counts)
+			}
+		})
+	}
+}
+
+func TestBuiltinDetectorsFitHoldback(t *testing.T) {
+	for name, build := range builtinDetectors {
+		if n := maxLength(build().pattern.String()); n < 0 || n > Holdback {
+			t.Errorf("%s matches up to %d bytes, holdback is %d", name, n, Holdback)
+		}
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    int
+	}{
+		{`EMP-\d{6}`, 10},
+		{`(?:AB|CDE)-[0-9]{2,4}`, 8},
+		{`é{3}`, 6},
+		{`^\bID\d?$`, 3},
+		{`[A-Z]+`, -1},
+		{`K-.*`, -1},
+		{`X\d{2,}`, -1},
+	}
+	for _, tt := range tests {
+		if got := maxLength(tt.pattern); got != tt.want {
+			t.Errorf("maxLength(%q) = %d, want %d", tt.pattern, got, tt.want)
+		}
+	}
+}
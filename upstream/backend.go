@@ -0,0 +1,68 @@
+package upstream
+
+import (
+	"sync/atomic"
+)
+
+type Backend struct {
+	URL    string
+	Weight int
+
+	healthy   atomic.Bool
+	inflight  atomic.Int64
+	inventory atomic.Pointer[inventory]
+
+	// consecutive probe results and smooth weighted round-robin state, guarded by Pool.mu
+	failures      int
+	successes     int
+	currentWeight int
+
+	breaker breaker
+}
+
+func newBackend(url string, weight int) *Backend {
+	if weight <= 0 {
+		weight = 1
+	}
+	b := &Backend{URL: url, Weight: weight}
+	b.healthy.Store(true)
+	b.setBreakerState(BreakerClosed)
+	return b
+}
+
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+func (b *Backend) Inflight() int64 {
+	return b.inflight.Load()
+}
+
+// Acquire marks a request as in flight on this backend, the returned func must be called once it is done.
+func (b *Backend) Acquire() func() {
+	b.inflight.Add(1)
+	var once atomic.Bool
+	return func() {
+		if once.CompareAndSwap(false, true) {
+			b.inflight.Add(-1)
+		}
+	}
+}
+
+type BackendStatus struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	Inflight int64  `json:"inflight"`
+	Circuit  string `json:"circuit"`
+}
+
+func (b *Backend) Status() BackendStatus {
+	return BackendStatus{
+		URL:      b.URL,
+		Weight:   b.Weight,
+		Healthy:  b.Healthy(),
+		Inflight: b.Inflight(),
+		Circuit:  b.BreakerState(),
+	}
+}
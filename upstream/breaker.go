@@ -0,0 +1,155 @@
+package upstream
+
+import (
+	"fmt"
+	"log/slog"
+	"safe-ollama/config"
+	"safe-ollama/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// CircuitOpenError is returned when every backend that could serve a request has an open circuit breaker.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("ollama backend circuit open, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+var (
+	breakerState = metrics.NewGauge("safe_ollama_backend_circuit_state",
+		"Circuit breaker state per backend: 0 closed, 1 half open, 2 open.", "backend")
+	breakerTrips = metrics.NewCounter("safe_ollama_backend_circuit_trips_total",
+		"Times a backend circuit breaker opened.", "backend")
+)
+
+// breaker opens after consecutive failed requests. Once open_duration has passed it lets a few trial requests
+// through (half open) and closes again if they succeed.
+type breaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trials   int // admitted trial requests while half open
+	// counts half open periods, a trial request carries the period it was admitted in
+	halfOpen uint64
+}
+
+// Admission is a request admitted to a backend by its circuit breaker, its outcome must be recorded once
+// with RecordResult or RecordCancelled.
+type Admission struct {
+	*Backend
+	// the half open period the request is a trial of, 0 if it is not a trial
+	trial uint64
+}
+
+// RecordResult feeds the outcome of the request into the circuit breaker of its backend. Connection errors,
+// timeouts and 5xx responses are failures.
+func (a *Admission) RecordResult(ok bool) {
+	a.recordResult(ok, a.trial)
+}
+
+// RecordCancelled frees the trial slot of a request the client gave up on, without judging the backend.
+func (a *Admission) RecordCancelled() {
+	br := &a.breaker
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.state == BreakerHalfOpen && a.trial == br.halfOpen {
+		br.trials--
+	}
+}
+
+func (b *Backend) setBreakerState(state string) {
+	b.breaker.state = state
+	value := map[string]float64{BreakerClosed: 0, BreakerHalfOpen: 1, BreakerOpen: 2}[state]
+	breakerState.Set(value, b.URL)
+}
+
+// breakerReady reports whether a request may be sent to the backend, or how long until it may.
+func (b *Backend) breakerReady(now time.Time) (bool, time.Duration) {
+	br := &b.breaker
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	switch br.state {
+	case BreakerOpen:
+		wait := br.openedAt.Add(time.Duration(config.OllamaBreakerOpenDuration) * time.Second).Sub(now)
+		return wait <= 0, wait
+	case BreakerHalfOpen:
+		return br.trials < config.OllamaBreakerHalfOpenRequests, time.Second
+	default:
+		return true, 0
+	}
+}
+
+// breakerAdmit is called once the backend is picked, an expired open circuit turns half open. It returns the
+// half open period the request is a trial of, 0 if the circuit is closed.
+func (b *Backend) breakerAdmit() uint64 {
+	br := &b.breaker
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.state == BreakerOpen {
+		b.setBreakerState(BreakerHalfOpen)
+		br.trials = 0
+		br.halfOpen++
+		slog.Info("[Upstream] circuit half open", "url", b.URL)
+	}
+	if br.state != BreakerHalfOpen {
+		return 0
+	}
+	br.trials++
+	return br.halfOpen
+}
+
+func (b *Backend) recordResult(ok bool, trial uint64) {
+	if config.OllamaBreakerFailureThreshold <= 0 {
+		return
+	}
+	br := &b.breaker
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.state == BreakerHalfOpen {
+		// only the trials of this period decide, not requests still running from before the circuit opened
+		if trial != br.halfOpen {
+			return
+		}
+		br.trials--
+		if ok {
+			br.failures = 0
+			b.setBreakerState(BreakerClosed)
+			slog.Info("[Upstream] circuit closed", "url", b.URL)
+		} else {
+			b.openBreaker()
+		}
+		return
+	}
+	if ok {
+		br.failures = 0
+		return
+	}
+	br.failures++
+	if br.state == BreakerClosed && br.failures >= config.OllamaBreakerFailureThreshold {
+		b.openBreaker()
+	}
+}
+
+// openBreaker trips the circuit. Caller holds b.breaker.mu.
+func (b *Backend) openBreaker() {
+	b.setBreakerState(BreakerOpen)
+	b.breaker.openedAt = time.Now()
+	breakerTrips.Inc(b.URL)
+	slog.Warn("[Upstream] circuit open", "url", b.URL, "failures", b.breaker.failures)
+}
+
+func (b *Backend) BreakerState() string {
+	b.breaker.mu.Lock()
+	defer b.breaker.mu.Unlock()
+	return b.breaker.state
+}
@@ -0,0 +1,174 @@
+package upstream
+
+import (
+	"errors"
+	"safe-ollama/config"
+	"testing"
+	"time"
+)
+
+func withBreakerConfig(t *testing.T, threshold, openDuration, halfOpen int) {
+	t.Helper()
+	old := []int{config.OllamaBreakerFailureThreshold, config.OllamaBreakerOpenDuration, config.OllamaBreakerHalfOpenRequests}
+	config.OllamaBreakerFailureThreshold = threshold
+	config.OllamaBreakerOpenDuration = openDuration
+	config.OllamaBreakerHalfOpenRequests = halfOpen
+	t.Cleanup(func() {
+		config.OllamaBreakerFailureThreshold = old[0]
+		config.OllamaBreakerOpenDuration = old[1]
+		config.OllamaBreakerHalfOpenRequests = old[2]
+	})
+}
+
+func withPool(t *testing.T, backends ...*Backend) {
+	t.Helper()
+	old := pool
+	pool = &Pool{backends: backends, strategy: RoundRobin}
+	t.Cleanup(func() { pool = old })
+}
+
+// expire moves the opening of the circuit back so that open_duration has passed.
+func expire(b *Backend) {
+	b.breaker.mu.Lock()
+	b.breaker.openedAt = b.breaker.openedAt.Add(-time.Hour)
+	b.breaker.mu.Unlock()
+}
+
+func TestBreakerStateMachine(t *testing.T) {
+	withBreakerConfig(t, 2, 30, 1)
+	a := newBackend("http://a", 1)
+	withPool(t, a)
+
+	a.recordResult(false, 0)
+	if state := a.BreakerState(); state != BreakerClosed {
+		t.Fatalf("state after one failure = %s, want %s", state, BreakerClosed)
+	}
+	a.recordResult(false, 0)
+	if state := a.BreakerState(); state != BreakerOpen {
+		t.Fatalf("state after threshold failures = %s, want %s", state, BreakerOpen)
+	}
+
+	var circuitOpen *CircuitOpenError
+	if _, err := Pick(); !errors.As(err, &circuitOpen) {
+		t.Fatalf("Pick with open circuit: err = %v, want CircuitOpenError", err)
+	}
+
+	expire(a)
+	trial, err := Pick()
+	if err != nil || trial.Backend != a {
+		t.Fatalf("Pick after open duration = %v, %v", trial, err)
+	}
+	if state := a.BreakerState(); state != BreakerHalfOpen {
+		t.Fatalf("state after trial admitted = %s, want %s", state, BreakerHalfOpen)
+	}
+	if _, err := Pick(); !errors.As(err, &circuitOpen) {
+		t.Fatalf("Pick with trial in use: err = %v, want CircuitOpenError", err)
+	}
+
+	// a failed trial opens the circuit again
+	trial.RecordResult(false)
+	if state := a.BreakerState(); state != BreakerOpen {
+		t.Fatalf("state after failed trial = %s, want %s", state, BreakerOpen)
+	}
+
+	// a successful trial closes it
+	expire(a)
+	trial, err = Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trial.RecordResult(true)
+	if state := a.BreakerState(); state != BreakerClosed {
+		t.Fatalf("state after successful trial = %s, want %s", state, BreakerClosed)
+	}
+}
+
+func TestBreakerCancelledTrialIsReleased(t *testing.T) {
+	withBreakerConfig(t, 1, 30, 1)
+	a := newBackend("http://a", 1)
+	withPool(t, a)
+
+	a.recordResult(false, 0)
+	expire(a)
+	trial, err := Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trial.RecordCancelled()
+	if state := a.BreakerState(); state != BreakerHalfOpen {
+		t.Fatalf("state after cancelled trial = %s, want %s", state, BreakerHalfOpen)
+	}
+	// the trial slot is free again
+	if b, err := Pick(); err != nil || b.Backend != a {
+		t.Fatalf("Pick after cancelled trial = %v, %v", b, err)
+	}
+}
+
+// Requests admitted before the circuit opened, like long streams, finish while it is half open. Their
+// results must neither decide the state nor free trial slots.
+func TestBreakerIgnoresResultsOfEarlierRequests(t *testing.T) {
+	withBreakerConfig(t, 1, 30, 1)
+	a := newBackend("http://a", 1)
+	withPool(t, a)
+
+	stream, err := Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.recordResult(false, 0)
+	expire(a)
+	trial, err := Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.RecordResult(true)
+	if state := a.BreakerState(); state != BreakerHalfOpen {
+		t.Fatalf("state after an earlier request succeeded = %s, want %s", state, BreakerHalfOpen)
+	}
+	stream.RecordCancelled()
+	var circuitOpen *CircuitOpenError
+	if _, err := Pick(); !errors.As(err, &circuitOpen) {
+		t.Fatalf("Pick beyond half_open_requests: err = %v, want CircuitOpenError", err)
+	}
+
+	// a trial of an earlier half open period does not count either
+	trial.RecordResult(false)
+	expire(a)
+	next, err := Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trial.RecordResult(true)
+	if state := a.BreakerState(); state != BreakerHalfOpen {
+		t.Fatalf("state after a trial of an earlier period = %s, want %s", state, BreakerHalfOpen)
+	}
+	next.RecordResult(true)
+	if state := a.BreakerState(); state != BreakerClosed {
+		t.Fatalf("state after the trial succeeded = %s, want %s", state, BreakerClosed)
+	}
+}
+
+func TestBreakerExcludedBackendIsNotAdmitted(t *testing.T) {
+	withBreakerConfig(t, 1, 30, 1)
+	a := newBackend("http://a", 1)
+	b := newBackend("http://b", 1)
+	withPool(t, a, b)
+
+	a.recordResult(false, 0)
+	expire(a)
+	// failover away from a must not take its only trial
+	for i := 0; i < 3; i++ {
+		got, err := Pick(a)
+		if err != nil || got.Backend != b {
+			t.Fatalf("Pick(a) = %v, %v, want b", got, err)
+		}
+		got.RecordResult(true)
+	}
+	if state := a.BreakerState(); state != BreakerOpen {
+		t.Fatalf("state of excluded backend = %s, want %s", state, BreakerOpen)
+	}
+	if got, err := Pick(b); err != nil || got.Backend != a {
+		t.Fatalf("Pick(b) = %v, %v, want a", got, err)
+	}
+}
@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"safe-ollama/config"
+	"time"
+)
+
+var probeClient = &http.Client{}
+
+func (p *Pool) healthCheckLoop() {
+	interval := time.Duration(config.OllamaHealthInterval) * time.Second
+	if interval <= 0 {
+		slog.Info("[Upstream] health check disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, b := range p.backends {
+			go p.probe(b)
+		}
+		<-ticker.C
+	}
+}
+
+func (p *Pool) probe(b *Backend) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.OllamaHealthTimeout)*time.Second)
+	defer cancel()
+
+	ok := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL+"/api/version", nil)
+	if err == nil {
+		resp, err := probeClient.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			ok = resp.StatusCode == http.StatusOK
+		}
+	}
+	p.report(b, ok)
+}
+
+// report records a probe result and ejects or re-admits the backend once the configured threshold is reached.
+func (p *Pool) report(b *Backend, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		b.failures = 0
+		b.successes++
+		if !b.Healthy() && b.successes >= config.OllamaHealthyThreshold {
+			b.healthy.Store(true)
+			slog.Info("[Upstream] backend re-admitted", "url", b.URL)
+		}
+	} else {
+		b.successes = 0
+		b.failures++
+		if b.Healthy() && b.failures >= config.OllamaUnhealthyThreshold {
+			b.healthy.Store(false)
+			slog.Warn("[Upstream] backend ejected", "url", b.URL, "failures", b.failures)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"safe-ollama/config"
+	"strings"
+	"time"
+)
+
+type inventory struct {
+	models map[string]bool
+	loaded map[string]bool
+}
+
+// NormalizeModel appends the implicit ":latest" tag so that "llama3" and "llama3:latest" match.
+func NormalizeModel(name string) string {
+	name = strings.TrimSpace(name)
+	if name != "" && !strings.Contains(name, ":") {
+		name += ":latest"
+	}
+	return name
+}
+
+// hasModel reports whether the backend hosts the model, known is false until the first successful refresh.
+func (b *Backend) hasModel(model string) (has, loaded, known bool) {
+	inv := b.inventory.Load()
+	if inv == nil {
+		return false, false, false
+	}
+	return inv.models[model], inv.loaded[model], true
+}
+
+// Models returns the names of the models hosted on the backend.
+func (b *Backend) Models() []string {
+	inv := b.inventory.Load()
+	if inv == nil {
+		return nil
+	}
+	models := make([]string, 0, len(inv.models))
+	for m := range inv.models {
+		models = append(models, m)
+	}
+	return models
+}
+
+// PickForModel selects a healthy backend hosting the model, preferring those that already have it loaded.
+// Backends whose inventory has not been fetched yet come next, and if no backend lists the model any
+// backend is picked so that Ollama answers for a model the inventory does not know about yet.
+func PickForModel(model string, exclude ...*Backend) (*Admission, error) {
+	if model == "" {
+		return Pick(exclude...)
+	}
+	model = NormalizeModel(model)
+
+	filters := []func(b *Backend) bool{
+		func(b *Backend) bool {
+			_, loaded, _ := b.hasModel(model)
+			return loaded
+		},
+		func(b *Backend) bool {
+			has, _, _ := b.hasModel(model)
+			return has
+		},
+		func(b *Backend) bool {
+			_, _, known := b.hasModel(model)
+			return !known
+		},
+	}
+	var circuitOpen *CircuitOpenError
+	for _, filter := range filters {
+		b, err := pool.pick(filter, exclude)
+		if err == nil {
+			return b, nil
+		}
+		errors.As(err, &circuitOpen)
+	}
+
+	if circuitOpen != nil {
+		return nil, circuitOpen
+	}
+	for _, b := range pool.backends {
+		if has, _, _ := b.hasModel(model); has {
+			// the model exists but every backend hosting it is unhealthy
+			return nil, ErrNoBackend
+		}
+	}
+	return Pick(exclude...)
+}
+
+func (p *Pool) inventoryLoop() {
+	interval := time.Duration(config.OllamaInventoryInterval) * time.Second
+	if interval <= 0 {
+		slog.Info("[Upstream] model inventory disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, b := range p.backends {
+			go b.RefreshInventory()
+		}
+		<-ticker.C
+	}
+}
+
+// RefreshInventory fetches the models hosted and loaded on the backend.
+func (b *Backend) RefreshInventory() {
+	models, err := fetchModelNames(b.URL + "/api/tags")
+	if err != nil {
+		slog.Warn("[Upstream] fail to fetch model list", "url", b.URL, "error", err)
+		return
+	}
+	loaded, err := fetchModelNames(b.URL + "/api/ps")
+	if err != nil {
+		slog.Warn("[Upstream] fail to fetch running models", "url", b.URL, "error", err)
+		loaded = map[string]bool{}
+	}
+	b.inventory.Store(&inventory{models: models, loaded: loaded})
+	slog.Debug("[Upstream] inventory refreshed", "url", b.URL, "models", len(models), "loaded", len(loaded))
+}
+
+func fetchModelNames(url string) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.OllamaHealthTimeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var data struct {
+		Models []struct {
+			Name  string `json:"name"`
+			Model string `json:"model"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(data.Models))
+	for _, m := range data.Models {
+		if m.Name != "" {
+			names[NormalizeModel(m.Name)] = true
+		}
+		if m.Model != "" {
+			names[NormalizeModel(m.Model)] = true
+		}
+	}
+	return names, nil
+}
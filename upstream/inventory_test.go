@@ -0,0 +1,49 @@
+package upstream
+
+import "testing"
+
+func withInventory(b *Backend, models ...string) {
+	inv := &inventory{models: map[string]bool{}, loaded: map[string]bool{}}
+	for _, m := range models {
+		inv.models[NormalizeModel(m)] = true
+	}
+	b.inventory.Store(inv)
+}
+
+func TestPickForModel(t *testing.T) {
+	withBreakerConfig(t, 0, 30, 1)
+	a := newBackend("http://a", 1)
+	b := newBackend("http://b", 1)
+	withPool(t, a, b)
+	withInventory(a, "llama3")
+	withInventory(b, "mistral:7b")
+
+	tests := []struct {
+		model string
+		want  []*Backend
+	}{
+		{"llama3", []*Backend{a}},
+		{"llama3:latest", []*Backend{a}},
+		{"mistral:7b", []*Backend{b}},
+		// not listed anywhere yet, for example just pulled: any backend, Ollama answers for it
+		{"qwen2", []*Backend{a, b}},
+	}
+	for _, tt := range tests {
+		seen := map[*Backend]bool{}
+		for i := 0; i < 4; i++ {
+			got, err := PickForModel(tt.model)
+			if err != nil {
+				t.Fatalf("PickForModel(%q): %v", tt.model, err)
+			}
+			seen[got.Backend] = true
+		}
+		if len(seen) != len(tt.want) {
+			t.Fatalf("PickForModel(%q) picked %d backends, want %d", tt.model, len(seen), len(tt.want))
+		}
+		for _, w := range tt.want {
+			if !seen[w] {
+				t.Fatalf("PickForModel(%q) never picked %s", tt.model, w.URL)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package upstream
+
+import (
+	"errors"
+	"log/slog"
+	"safe-ollama/config"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RoundRobin    = "round_robin"
+	LeastInflight = "least_inflight"
+	Weighted      = "weighted"
+)
+
+var ErrNoBackend = errors.New("no healthy ollama backend available")
+
+type Pool struct {
+	mu       sync.Mutex
+	backends []*Backend
+	strategy string
+	next     int
+}
+
+var pool *Pool
+
+// Init builds the backend pool from config and starts the health checker and model inventory refresher.
+func Init() {
+	var backends []*Backend
+	for _, b := range config.OllamaBackends {
+		backends = append(backends, newBackend(strings.TrimRight(b.URL, "/"), b.Weight))
+	}
+	strategy := config.OllamaBalance
+	switch strategy {
+	case RoundRobin, LeastInflight, Weighted:
+	default:
+		slog.Warn("[Upstream] Invalid balance strategy, using default value \"round_robin\"", "strategy", strategy)
+		strategy = RoundRobin
+	}
+	pool = &Pool{backends: backends, strategy: strategy}
+	slog.Info("[Upstream] backend pool initialized", "backends", len(backends), "strategy", strategy)
+
+	go pool.healthCheckLoop()
+	go pool.inventoryLoop()
+}
+
+// Pick selects a healthy backend according to the configured strategy, skipping the excluded ones.
+func Pick(exclude ...*Backend) (*Admission, error) {
+	return pool.pick(nil, exclude)
+}
+
+// Available returns the healthy backends whose circuit is closed, for requests sent to every backend.
+func Available() []*Backend {
+	var result []*Backend
+	for _, b := range pool.backends {
+		if b.Healthy() && b.BreakerState() == BreakerClosed {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// Backends returns the status of every configured backend.
+func Backends() []BackendStatus {
+	result := make([]BackendStatus, 0, len(pool.backends))
+	for _, b := range pool.backends {
+		result = append(result, b.Status())
+	}
+	return result
+}
+
+func (p *Pool) pick(filter func(*Backend) bool, exclude []*Backend) (*Admission, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var candidates []*Backend
+	var circuitOpen *CircuitOpenError
+	for _, b := range p.backends {
+		if !b.Healthy() || (filter != nil && !filter(b)) || slices.Contains(exclude, b) {
+			continue
+		}
+		if ready, wait := b.breakerReady(now); !ready {
+			if circuitOpen == nil || wait < circuitOpen.RetryAfter {
+				circuitOpen = &CircuitOpenError{RetryAfter: wait}
+			}
+			continue
+		}
+		candidates = append(candidates, b)
+	}
+	if len(candidates) == 0 {
+		if circuitOpen != nil {
+			return nil, circuitOpen
+		}
+		return nil, ErrNoBackend
+	}
+
+	var b *Backend
+	switch p.strategy {
+	case LeastInflight:
+		b = p.pickLeastInflight(candidates)
+	case Weighted:
+		b = p.pickWeighted(candidates)
+	default:
+		b = candidates[p.next%len(candidates)]
+		p.next++
+	}
+	return &Admission{Backend: b, trial: b.breakerAdmit()}, nil
+}
+
+func (p *Pool) pickLeastInflight(candidates []*Backend) *Backend {
+	// start from a rotating offset so that ties are spread across backends
+	start := p.next % len(candidates)
+	p.next++
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		b := candidates[(start+i)%len(candidates)]
+		// compare inflight/weight without floats
+		if b.Inflight()*int64(best.Weight) < best.Inflight()*int64(b.Weight) {
+			best = b
+		}
+	}
+	return best
+}
+
+// pickWeighted implements nginx's smooth weighted round-robin.
+func (p *Pool) pickWeighted(candidates []*Backend) *Backend {
+	total := 0
+	var best *Backend
+	for _, b := range candidates {
+		b.currentWeight += b.Weight
+		total += b.Weight
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+	best.currentWeight -= total
+	return best
+}